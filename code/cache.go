@@ -0,0 +1,291 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheVersion is the version of the cache entries, it must be changed whenever
+// the rewriting results of the same options change
+const cacheVersion = "1"
+
+// CacheDirEnv is the environment variable of the cache directory
+const CacheDirEnv = "FAILPOINT_CACHE_DIR"
+
+const (
+	// cacheMaxAge is the age of the unused entries removed by Trim
+	cacheMaxAge = 5 * 24 * time.Hour
+	// cacheTrimInterval is the minimal interval between two trims of the cache
+	cacheTrimInterval = 24 * time.Hour
+	// cacheMarkInterval is the precision of the last used time of the entries,
+	// an entry is marked as used only if it has not been marked recently
+	cacheMarkInterval = time.Hour
+	// cacheTrimFile records the time of the last trim in its modification time
+	cacheTrimFile = "trim.txt"
+)
+
+// Cache is a content-addressed cache of the rewriting results. The key of a file
+// is the hash of its original content, its path, the options of the rewriter and
+// the version of the failpoint package, so a result is reused only if the file
+// would be rewritten to the same content. The entries are never invalidated, but
+// the ones unused for 5 days are removed by Trim. The directory can be removed at
+// any time.
+type Cache struct {
+	dir string
+}
+
+// NewCache returns a cache which stores the entries in the directory
+func NewCache(dir string) *Cache {
+	return &Cache{dir: dir}
+}
+
+// DefaultCacheDir returns the directory of the cache, which is $FAILPOINT_CACHE_DIR
+// if it is set, otherwise the `failpoint` directory in the user cache directory.
+func DefaultCacheDir() (string, error) {
+	if dir := os.Getenv(CacheDirEnv); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "failpoint"), nil
+}
+
+// Dir returns the directory of the cache
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// SetCache sets the cache of the rewriting results, the files rewritten before are
+// not parsed or rewritten again. The files rewritten in the type-aware mode are not
+// cached, as their results depend on the other files of the packages.
+func (r *Rewriter) SetCache(c *Cache) {
+	r.cache = c
+}
+
+// cacheEntry is the rewriting result of a file, the rewritten content is stored
+// in a Go file next to the entry, so it can be compiled in place.
+type cacheEntry struct {
+	Rewritten bool     `json:"rewritten"`
+	Package   string   `json:"package,omitempty"`
+	LineMap   *LineMap `json:"line_map,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+
+	content []byte
+}
+
+func (c *Cache) entryPath(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+func (c *Cache) contentPath(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".go")
+}
+
+// get returns the entry of the key, it returns nil if the entry does not exist
+// or can not be read
+func (c *Cache) get(key string) *cacheEntry {
+	data, err := os.ReadFile(c.entryPath(key))
+	if err != nil {
+		return nil
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil
+	}
+	if entry.Rewritten {
+		if entry.content, err = os.ReadFile(c.contentPath(key)); err != nil {
+			return nil
+		}
+	}
+	c.markUsed(key)
+	return entry
+}
+
+// markUsed updates the modification time of the entry of the key, which is the
+// last used time checked by Trim. The errors are ignored as the entry is rewritten
+// again at worst.
+func (c *Cache) markUsed(key string) {
+	path := c.entryPath(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(info.ModTime()) < cacheMarkInterval {
+		return
+	}
+	_ = os.Chtimes(path, now, now)
+	_ = os.Chtimes(c.contentPath(key), now, now)
+}
+
+// Trim removes the entries which have not been used for 5 days, the directory is
+// scanned at most once a day and the other calls return immediately.
+func (c *Cache) Trim() error {
+	now := time.Now()
+	trimFile := filepath.Join(c.dir, cacheTrimFile)
+	if info, err := os.Stat(trimFile); err == nil && now.Sub(info.ModTime()) < cacheTrimInterval {
+		return nil
+	}
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, dir := range dirs {
+		// the entries are in the subdirectories named by the prefixes of the keys
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		subdir := filepath.Join(c.dir, dir.Name())
+		files, err := os.ReadDir(subdir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			info, err := file.Info()
+			if err != nil || now.Sub(info.ModTime()) < cacheMaxAge {
+				continue
+			}
+			name := file.Name()
+			switch {
+			case strings.HasSuffix(name, ".json"):
+				// the entry is removed before its content, so that an entry is
+				// never read without its content
+				key := strings.TrimSuffix(name, ".json")
+				if err := os.Remove(c.entryPath(key)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				if err := os.Remove(c.contentPath(key)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			case strings.Contains(name, ".tmp"):
+				// the temporary files left by the interrupted writes
+				if err := os.Remove(filepath.Join(subdir, name)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+	return os.WriteFile(trimFile, []byte(now.Format(time.RFC3339)+"\n"), 0644)
+}
+
+// put stores the entry of the key, the content is stored before the entry so
+// that an entry is never read without its content
+func (c *Cache) put(key string, entry *cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.entryPath(key)), 0755); err != nil {
+		return err
+	}
+	if entry.Rewritten {
+		if err := writeFileAtomic(c.contentPath(key), entry.content); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(c.entryPath(key), data)
+}
+
+// writeFileAtomic writes the file by renaming a temporary file, so the file is
+// never read partially by the concurrent processes, e.g. the compilers run by
+// `failpoint-toolexec`
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// cacheKey returns the key of the file rewritten in the write mode
+func (r *Rewriter) cacheKey(path string, src []byte, mode string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%t\x00%t\x00%s\x00",
+		cacheVersion, rewriterVersion(), mode, r.lineFile, r.lineDirectives, r.strict, absPath)
+	h.Write(src)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+var (
+	versionOnce sync.Once
+	version     string
+)
+
+// rewriterVersion returns the version of the failpoint package built into the
+// running program. The development builds are identified by the path, the size and
+// the modification time of the executable, which are cheaper to get than its hash
+// in every compiler process run by `failpoint-toolexec`.
+func rewriterVersion() string {
+	versionOnce.Do(func() {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			mod := &info.Main
+			for _, dep := range info.Deps {
+				if dep.Path == packagePath {
+					mod = dep
+				}
+			}
+			if mod.Replace != nil {
+				mod = mod.Replace
+			}
+			if mod.Path == packagePath && mod.Version != "" && mod.Version != "(devel)" {
+				version = mod.Version
+				return
+			}
+		}
+		version = "unknown"
+		exe, err := os.Executable()
+		if err != nil {
+			return
+		}
+		info, err := os.Stat(exe)
+		if err != nil {
+			return
+		}
+		version = fmt.Sprintf("%s@%d@%d", exe, info.Size(), info.ModTime().UnixNano())
+	})
+	return version
+}
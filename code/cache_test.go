@@ -0,0 +1,156 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pingcap/failpoint/code"
+)
+
+func TestRewriteCache(t *testing.T) {
+	original := `
+package cache
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", func() {
+		fmt.Println("unit-test")
+	})
+}
+`
+	tempDir := t.TempDir()
+	cacheDir := t.TempDir()
+	cache := code.NewCache(cacheDir)
+	fileName := filepath.Join(tempDir, "cache.go")
+	require.NoError(t, os.WriteFile(fileName, []byte(original), 0644))
+
+	enable := func() string {
+		rewriter := code.NewRewriter(tempDir)
+		rewriter.SetLineDirectives(true)
+		rewriter.SetCache(cache)
+		require.NoError(t, rewriter.Rewrite())
+		require.Equal(t, 1, rewriter.Stats().Rewritten)
+		content, err := os.ReadFile(fileName)
+		require.NoError(t, err)
+		require.NoError(t, code.NewRestorer(tempDir).Restore())
+		return string(content)
+	}
+	rewritten := enable()
+	require.Contains(t, rewritten, "failpoint.Eval(_curpkg_(\"failpoint-name\"))")
+
+	// The cached result is reused without rewriting the file again
+	cached, err := filepath.Glob(filepath.Join(cacheDir, "*", "*.go"))
+	require.NoError(t, err)
+	require.Len(t, cached, 1)
+	require.NoError(t, os.WriteFile(cached[0], []byte(rewritten+"// cached\n"), 0644))
+	require.Equal(t, rewritten+"// cached\n", enable())
+
+	// The modified file is rewritten again
+	require.NoError(t, os.WriteFile(fileName, []byte(original+"\nfunc other() {}\n"), 0644))
+	require.Equal(t, rewritten+"\nfunc other() {}\n", enable())
+
+	// The file is rewritten to the cache with the absolute line directives
+	rewriter := code.NewRewriter(fileName)
+	rewriter.SetLineDirectives(true)
+	rewriter.SetCache(cache)
+	path, err := rewriter.RewriteFileToCache(fileName)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(path, cacheDir))
+	require.True(t, rewriter.GetRewritten())
+	require.NotNil(t, rewriter.GetLineMap())
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "\n//line "+fileName+":")
+
+	// The files without the failpoint package are not cached
+	entries, err := filepath.Glob(filepath.Join(cacheDir, "*", "*.json"))
+	require.NoError(t, err)
+	plain := filepath.Join(tempDir, "plain.go")
+	require.NoError(t, os.WriteFile(plain, []byte("package cache\n\nfunc plain() {}\n"), 0644))
+	rewriter.SetAllowNotChecked(true)
+	path, err = rewriter.RewriteFileToCache(plain)
+	require.NoError(t, err)
+	require.Empty(t, path)
+	require.False(t, rewriter.GetRewritten())
+	plainEntries, err := filepath.Glob(filepath.Join(cacheDir, "*", "*.json"))
+	require.NoError(t, err)
+	require.Equal(t, entries, plainEntries)
+}
+
+func TestTrimCache(t *testing.T) {
+	tempDir := t.TempDir()
+	cacheDir := t.TempDir()
+	cache := code.NewCache(cacheDir)
+	fileName := filepath.Join(tempDir, "trim.go")
+	rewrite := func(name string) string {
+		content := "package trim\n\nimport \"github.com/pingcap/failpoint\"\n\nfunc " + name + "() {\n\tfailpoint.Inject(\"" + name + "\", nil)\n}\n"
+		require.NoError(t, os.WriteFile(fileName, []byte(content), 0644))
+		rewriter := code.NewRewriter(fileName)
+		rewriter.SetCache(cache)
+		path, err := rewriter.RewriteFileToCache(fileName)
+		require.NoError(t, err)
+		require.NotEmpty(t, path)
+		return path
+	}
+	setAge := func(path string, age time.Duration) {
+		old := time.Now().Add(-age)
+		require.NoError(t, os.Chtimes(path, old, old))
+		require.NoError(t, os.Chtimes(strings.TrimSuffix(path, ".go")+".json", old, old))
+	}
+	modTime := func(path string) time.Time {
+		info, err := os.Stat(strings.TrimSuffix(path, ".go") + ".json")
+		require.NoError(t, err)
+		return info.ModTime()
+	}
+
+	unused := rewrite("unused")
+	setAge(unused, 6*24*time.Hour)
+	used := rewrite("used")
+	setAge(used, 4*24*time.Hour)
+	// The entry used again is marked as recently used
+	require.Equal(t, used, rewrite("used"))
+	require.WithinDuration(t, time.Now(), modTime(used), time.Minute)
+	setAge(used, 6*24*time.Hour)
+	recent := rewrite("recent")
+	setAge(recent, 4*24*time.Hour)
+	used = rewrite("used")
+
+	require.NoError(t, cache.Trim())
+	require.NoFileExists(t, unused)
+	require.NoFileExists(t, strings.TrimSuffix(unused, ".go")+".json")
+	require.FileExists(t, used)
+	require.FileExists(t, recent)
+	require.FileExists(t, filepath.Join(cacheDir, "trim.txt"))
+
+	// The cache is trimmed at most once a day
+	setAge(recent, 6*24*time.Hour)
+	require.NoError(t, cache.Trim())
+	require.FileExists(t, recent)
+
+	// A missing directory has nothing to trim
+	require.NoError(t, code.NewCache(filepath.Join(tempDir, "missing")).Trim())
+}
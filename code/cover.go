@@ -0,0 +1,409 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// failpointLineMapDirName is the sidecar directory of the line maps at the
+	// root of the rewrite path, the line map of a rewritten file is stored by
+	// its path relative to the root, e.g. `__failpoint_linemaps__/pkg/foo.go.json`
+	failpointLineMapDirName = "__failpoint_linemaps__"
+	lineMapFileExt          = ".json"
+	// toolexecExtraFileName is the binding file generated by failpoint-toolexec
+	toolexecExtraFileName = "failpoint_toolexec_extra.go"
+)
+
+// lineMapPath returns the path of the line map of the rewritten file in the
+// sidecar directory of the root
+func lineMapPath(root, rewrittenPath string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(rewrittenPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not under %s", rewrittenPath, root)
+	}
+	return filepath.Join(absRoot, failpointLineMapDirName, rel+lineMapFileExt), nil
+}
+
+// lineMapOwner returns the rewritten file of the line map, it returns false if
+// the path is not a line map in a sidecar directory
+func lineMapOwner(path string) (string, bool) {
+	if !strings.HasSuffix(path, lineMapFileExt) {
+		return "", false
+	}
+	for dir := filepath.Dir(path); filepath.Dir(dir) != dir; dir = filepath.Dir(dir) {
+		if filepath.Base(dir) != failpointLineMapDirName {
+			continue
+		}
+		rel, err := filepath.Rel(dir, strings.TrimSuffix(path, lineMapFileExt))
+		if err != nil {
+			return "", false
+		}
+		return filepath.Join(filepath.Dir(dir), rel), true
+	}
+	return "", false
+}
+
+// isLineMapFile returns whether the path is a line map in a sidecar directory
+func isLineMapFile(path string) bool {
+	_, ok := lineMapOwner(path)
+	return ok
+}
+
+// findLineMap returns the path of the line map of the rewritten file, the sidecar
+// directories are searched from the directory of the file up to the root of the
+// file system. It returns an empty string if the file has no line map.
+func findLineMap(rewrittenPath string) (string, error) {
+	absPath, err := filepath.Abs(rewrittenPath)
+	if err != nil {
+		return "", err
+	}
+	for dir := filepath.Dir(absPath); ; {
+		path, err := lineMapPath(dir, absPath)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// removeLineMap removes the line map of the rewritten file, the directories of
+// the sidecar directory are removed once they are empty
+func removeLineMap(rewrittenPath string) error {
+	path, err := findLineMap(rewrittenPath)
+	if err != nil || path == "" {
+		return err
+	}
+	return removeLineMapFile(path)
+}
+
+// removeLineMapFile removes the line map file in a sidecar directory, and the
+// empty directories up to and including the sidecar directory
+func removeLineMapFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(entries) > 0 {
+			return nil
+		}
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if filepath.Base(dir) == failpointLineMapDirName {
+			return nil
+		}
+	}
+}
+
+// readLineMap reads the line map file
+func readLineMap(path string) (*LineMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &LineMap{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid line map %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// WriteLineMap writes the line map of the rewritten file to the sidecar directory
+// of the root, which is read by the CoverRemapper to translate the coverage profiles.
+// The rewritten file must be under the root.
+func WriteLineMap(root, rewrittenPath string, m *LineMap) error {
+	if m == nil {
+		return nil
+	}
+	path, err := lineMapPath(root, rewrittenPath)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// CoverRemapper translates the coverage profiles of the rewritten files back to
+// the original files, by the line maps recorded during `failpoint-ctl enable`.
+type CoverRemapper struct {
+	paths []string
+	// maps are the line maps indexed by the absolute path of the rewritten file
+	maps map[string]*LineMap
+}
+
+// NewCoverRemapper returns a remapper which loads the line maps of the files
+// under the paths
+func NewCoverRemapper(paths ...string) *CoverRemapper {
+	return &CoverRemapper{paths: paths}
+}
+
+func (c *CoverRemapper) load() error {
+	c.maps = map[string]*LineMap{}
+	for _, root := range c.paths {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		// The sidecar directories of the parent directories contain the line
+		// maps of the files under the path if a parent directory was enabled
+		var dirs []string
+		for dir := filepath.Dir(absRoot); ; dir = filepath.Dir(dir) {
+			dirs = append(dirs, filepath.Join(dir, failpointLineMapDirName))
+			if filepath.Dir(dir) == dir {
+				break
+			}
+		}
+		err = filepath.Walk(absRoot, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && info.Name() == failpointLineMapDirName {
+				dirs = append(dirs, path)
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if err := c.loadDir(dir, absRoot); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadDir loads the line maps in the sidecar directory of the files under the root
+func (c *CoverRemapper) loadDir(dir, root string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rewritten, ok := lineMapOwner(path)
+		if info.IsDir() || !ok {
+			return nil
+		}
+		if rel, err := filepath.Rel(root, rewritten); err != nil ||
+			rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+		m, err := readLineMap(path)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(m.Original) {
+			m.Original = filepath.Join(filepath.Dir(rewritten), m.Original)
+		}
+		c.maps[rewritten] = m
+		return nil
+	})
+}
+
+// Remap reads the coverage profile from in and writes the remapped profile to out.
+// The blocks of the failpoint binding files are dropped, and the blocks of the
+// files without a line map are copied as is.
+func (c *CoverRemapper) Remap(in io.Reader, out io.Writer) error {
+	if err := c.load(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	w := bufio.NewWriter(out)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if lineNo == 1 && strings.HasPrefix(line, "mode:") {
+			fmt.Fprintln(w, line)
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, block, err := parseProfileLine(line)
+		if err != nil {
+			return fmt.Errorf("invalid coverage profile line %d: %v", lineNo, err)
+		}
+		base := filepath.Base(name)
+		if base == failpointBindingFileName || base == toolexecExtraFileName ||
+			base == generatedBindingName("") || base == generatedBindingName("_test") {
+			continue
+		}
+		if rewritten, m := c.lookup(name); m != nil {
+			if name == rewritten {
+				name = m.Original
+			}
+			block.remap(m)
+		}
+		fmt.Fprintf(w, "%s:%s\n", name, block)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// lookup returns the line map of the file in the profile. The profile names the
+// file by its absolute path or by its import path, so the rewritten file which
+// shares the longest unique path suffix with the name is chosen.
+func (c *CoverRemapper) lookup(name string) (string, *LineMap) {
+	if m, ok := c.maps[name]; ok {
+		return name, m
+	}
+	var found string
+	best, ambiguous := 0, false
+	for rewritten := range c.maps {
+		n := commonSuffixElems(filepath.ToSlash(rewritten), filepath.ToSlash(name))
+		switch {
+		case n > best:
+			found, best, ambiguous = rewritten, n, false
+		case n == best:
+			ambiguous = true
+		}
+	}
+	// The file name alone may refer to a file of another package
+	if best < 2 || ambiguous {
+		return "", nil
+	}
+	return found, c.maps[found]
+}
+
+func commonSuffixElems(a, b string) int {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	n := 0
+	for n < len(as) && n < len(bs) && as[len(as)-1-n] == bs[len(bs)-1-n] {
+		n++
+	}
+	return n
+}
+
+// profileBlock is a block of the coverage profile, e.g. `12.5,14.3 2 1`
+type profileBlock struct {
+	startLine, startCol int
+	endLine, endCol     int
+	rest                string
+}
+
+func parseProfileLine(line string) (string, *profileBlock, error) {
+	i := strings.LastIndex(line, ":")
+	if i < 0 {
+		return "", nil, fmt.Errorf("missing file name")
+	}
+	b := &profileBlock{}
+	var err error
+	fields := strings.SplitN(line[i+1:], " ", 2)
+	if len(fields) != 2 {
+		return "", nil, fmt.Errorf("missing statements count")
+	}
+	pos := strings.Split(fields[0], ",")
+	if len(pos) != 2 {
+		return "", nil, fmt.Errorf("invalid block %q", fields[0])
+	}
+	if b.startLine, b.startCol, err = parseLineCol(pos[0]); err != nil {
+		return "", nil, err
+	}
+	if b.endLine, b.endCol, err = parseLineCol(pos[1]); err != nil {
+		return "", nil, err
+	}
+	b.rest = fields[1]
+	return line[:i], b, nil
+}
+
+func parseLineCol(s string) (int, int, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid position %q", s)
+	}
+	line, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	col, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return line, col, nil
+}
+
+// remap translates the block to the original lines, the columns are clamped
+// to the original lines since they are computed from the rewritten text.
+func (b *profileBlock) remap(m *LineMap) {
+	mapLine := func(line int) int {
+		if line >= 1 && line <= len(m.Lines) {
+			return m.Lines[line-1]
+		}
+		return line
+	}
+	clamp := func(line, col int) int {
+		if line >= 1 && line <= len(m.Widths) && col > m.Widths[line-1]+1 {
+			return m.Widths[line-1] + 1
+		}
+		return col
+	}
+	b.startLine, b.endLine = mapLine(b.startLine), mapLine(b.endLine)
+	if b.endLine < b.startLine {
+		b.endLine = b.startLine
+	}
+	b.startCol, b.endCol = clamp(b.startLine, b.startCol), clamp(b.endLine, b.endCol)
+	if b.endLine == b.startLine && b.endCol < b.startCol {
+		b.endCol = b.startCol
+	}
+}
+
+func (b *profileBlock) String() string {
+	return fmt.Sprintf("%d.%d,%d.%d %s", b.startLine, b.startCol, b.endLine, b.endCol, b.rest)
+}
@@ -0,0 +1,103 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/failpoint/code"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoverRemap(t *testing.T) {
+	original := `
+package cover_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", func(
+		val failpoint.Value,
+	) {
+		fmt.Println("unit-test", val)
+	})
+	fmt.Println("after")
+}
+`
+	tempDir := t.TempDir()
+	pkgDir := filepath.Join(tempDir, "pkg")
+	require.NoError(t, os.MkdirAll(pkgDir, 0755))
+	fileName := filepath.Join(pkgDir, "cover.go")
+	require.NoError(t, os.WriteFile(fileName, []byte(original), 0644))
+
+	// Without line directives, the lines after the marker are shifted
+	rewriter := code.NewRewriter(tempDir)
+	require.NoError(t, rewriter.Rewrite())
+	content, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	afterLine := 0
+	for i, line := range strings.Split(string(content), "\n") {
+		if strings.Contains(line, `"after"`) {
+			afterLine = i + 1
+		}
+	}
+	require.NotEqual(t, 16, afterLine)
+
+	profile := strings.Join([]string{
+		"mode: set",
+		fmt.Sprintf("example.com/m/pkg/cover.go:%d.2,%d.80 1 1", afterLine, afterLine+1),
+		"example.com/m/pkg/binding__failpoint_binding__.go:10.2,11.1 1 1",
+		"example.com/m/other/other.go:3.2,4.1 1 0",
+		fmt.Sprintf("%s:%d.2,%d.22 1 0", fileName, afterLine, afterLine),
+	}, "\n")
+	out := &bytes.Buffer{}
+	require.NoError(t, code.NewCoverRemapper(tempDir).Remap(strings.NewReader(profile), out))
+	require.Equal(t, strings.Join([]string{
+		"mode: set",
+		// the end column is clamped to the length of the original line
+		"example.com/m/pkg/cover.go:16.2,17.2 1 1",
+		"example.com/m/other/other.go:3.2,4.1 1 0",
+		fileName + ":16.2,16.22 1 0",
+	}, "\n")+"\n", out.String())
+
+	// The line maps are kept in the sidecar directory of the rewrite path, so
+	// the line maps of the sub path are found by its parent directories
+	entries, err := os.ReadDir(pkgDir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NotContains(t, entry.Name(), "linemap")
+	}
+	_, err = os.Stat(filepath.Join(tempDir, "__failpoint_linemaps__", "pkg", "cover.go.json"))
+	require.NoError(t, err)
+	out.Reset()
+	require.NoError(t, code.NewCoverRemapper(pkgDir).Remap(strings.NewReader(profile), out))
+	require.Contains(t, out.String(), "example.com/m/pkg/cover.go:16.2,17.2 1 1\n")
+
+	// The line maps are removed by the restorer
+	require.NoError(t, code.NewRestorer(tempDir).Restore())
+	_, err = os.Stat(filepath.Join(tempDir, "__failpoint_linemaps__"))
+	require.True(t, os.IsNotExist(err))
+
+	require.Error(t, code.NewCoverRemapper(tempDir).Remap(strings.NewReader("mode: set\nbad line"), out))
+}
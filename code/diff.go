@@ -0,0 +1,118 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// diffLine is a line of the line-based diff
+type diffLine struct {
+	op   diffmatchpatch.Operation
+	text string
+}
+
+// UnifiedDiff returns the unified diff of the lines of the texts with the lines
+// of context around the changes, it is empty if the texts are the same.
+func UnifiedDiff(fromFile, toFile, a, b string, context int) string {
+	if a == b {
+		return ""
+	}
+	patcher := diffmatchpatch.New()
+	chars1, chars2, lines := patcher.DiffLinesToChars(a, b)
+	diffs := patcher.DiffCharsToLines(patcher.DiffMain(chars1, chars2, false), lines)
+	var all []diffLine
+	for _, diff := range diffs {
+		for _, line := range strings.SplitAfter(diff.Text, "\n") {
+			if line != "" {
+				all = append(all, diffLine{op: diff.Type, text: line})
+			}
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromFile, toFile)
+	// line1 and line2 are the numbers of the lines before all[i] in a and b
+	line1, line2 := 0, 0
+	for i := 0; i < len(all); {
+		if all[i].op == diffmatchpatch.DiffEqual {
+			line1, line2 = line1+1, line2+1
+			i++
+			continue
+		}
+		// The hunk starts with the context before the change and ends when
+		// the equal lines after the last change are more than twice the context
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end, equals := i, 0
+		for end < len(all) && equals <= 2*context {
+			if all[end].op == diffmatchpatch.DiffEqual {
+				equals++
+			} else {
+				equals = 0
+			}
+			end++
+		}
+		if equals > context {
+			end -= equals - context
+		}
+		start1, start2 := line1-(i-start), line2-(i-start)
+		count1, count2 := 0, 0
+		var hunk strings.Builder
+		for _, line := range all[start:end] {
+			prefix := " "
+			switch line.op {
+			case diffmatchpatch.DiffDelete:
+				prefix = "-"
+				count1++
+			case diffmatchpatch.DiffInsert:
+				prefix = "+"
+				count2++
+			default:
+				count1++
+				count2++
+			}
+			hunk.WriteString(prefix + line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				hunk.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n%s", hunkRange(start1, count1), hunkRange(start2, count2), hunk.String())
+		for _, line := range all[i:end] {
+			if line.op != diffmatchpatch.DiffInsert {
+				line1++
+			}
+			if line.op != diffmatchpatch.DiffDelete {
+				line2++
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// hunkRange formats the range of a hunk, the start of an empty range is the
+// line before it
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,60 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pingcap/failpoint/code"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	require.Empty(t, code.UnifiedDiff("a.go", "a.go", "same\n", "same\n", 3))
+
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n16\n"
+	require.Equal(t, `--- a.go
++++ a.go
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -12,5 +12,4 @@
+ 12
+ 13
+ 14
+-15
+-16
+\ No newline at end of file
++16
+`, code.UnifiedDiff("a.go", "a.go", a, b, 3))
+
+	// The hunks are merged if the changes are close
+	require.Equal(t, `--- a.go
++++ a.go
+@@ -1,3 +1,4 @@
++0
+ 1
+-2
++two
+ 3
+`, code.UnifiedDiff("a.go", "a.go", "1\n2\n3\n", "0\n1\ntwo\n3\n", 3))
+}
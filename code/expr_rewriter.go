@@ -35,6 +35,13 @@ var exprRewriters = map[string]exprRewriter{
 	"Return":        (*Rewriter).rewriteReturn,
 }
 
+// exprMarkers are the markers which are rewritten in the expressions
+var exprMarkers = map[string]bool{
+	overrideMarker: true,
+	caseMarker:     true,
+	afterMarker:    true,
+}
+
 func (r *Rewriter) rewriteInject(call *ast.CallExpr) (bool, ast.Stmt, error) {
 	if len(call.Args) != 2 {
 		return false, nil, fmt.Errorf("failpoint.Inject: expect 2 arguments but got %v in %s", len(call.Args), r.pos(call.Pos()))
@@ -72,10 +79,7 @@ func (r *Rewriter) rewriteInject(call *ast.CallExpr) (bool, ast.Stmt, error) {
 	}
 
 	checkCall := &ast.CallExpr{
-		Fun: &ast.SelectorExpr{
-			X:   &ast.Ident{NamePos: call.Pos(), Name: r.failpointName},
-			Sel: ast.NewIdent(evalFunction),
-		},
+		Fun:  r.failpointSelector(call.Pos(), evalFunction),
 		Args: []ast.Expr{fpnameExtendCall},
 	}
 	if isNilFunc || len(fpbody.Body.List) < 1 {
@@ -90,14 +94,22 @@ func (r *Rewriter) rewriteInject(call *ast.CallExpr) (bool, ast.Stmt, error) {
 
 	// closure signature:
 	// func(val failpoint.Value) {...}
+	// func(val T) {...}
 	// func() {...}
 	var argName *ast.Ident
 	if len(fpbody.Type.Params.List) > 0 {
 		arg := fpbody.Type.Params.List[0]
-		selector, ok := arg.Type.(*ast.SelectorExpr)
-		if !ok || selector.Sel.Name != "Value" || selector.X.(*ast.Ident).Name != r.failpointName {
+		if _, ok := arg.Type.(*ast.Ellipsis); ok {
 			return false, nil, fmt.Errorf("failpoint.Inject: invalid signature in %s", r.pos(call.Pos()))
 		}
+		// func(val T) {...} is converted by failpoint.EvalAs[T](...),
+		// the closure is skipped if the value is not T.
+		if !r.isValueType(arg.Type) {
+			checkCall.Fun = &ast.IndexExpr{
+				X:     r.failpointSelector(call.Pos(), evalAsFunction),
+				Index: arg.Type,
+			}
+		}
 		argName = arg.Names[0]
 	} else {
 		argName = ast.NewIdent("_")
@@ -169,10 +181,7 @@ func (r *Rewriter) rewriteInjectContext(call *ast.CallExpr) (bool, ast.Stmt, err
 	}
 
 	checkCall := &ast.CallExpr{
-		Fun: &ast.SelectorExpr{
-			X:   &ast.Ident{NamePos: call.Pos(), Name: r.failpointName},
-			Sel: ast.NewIdent(evalCtxFunction),
-		},
+		Fun:  r.failpointSelector(call.Pos(), evalCtxFunction),
 		Args: []ast.Expr{ctxname, fpnameExtendCall},
 	}
 	if isNilFunc || len(fpbody.Body.List) < 1 {
@@ -187,14 +196,22 @@ func (r *Rewriter) rewriteInjectContext(call *ast.CallExpr) (bool, ast.Stmt, err
 
 	// closure signature:
 	// func(val failpoint.Value) {...}
+	// func(val T) {...}
 	// func() {...}
 	var argName *ast.Ident
 	if len(fpbody.Type.Params.List) > 0 {
 		arg := fpbody.Type.Params.List[0]
-		selector, ok := arg.Type.(*ast.SelectorExpr)
-		if !ok || selector.Sel.Name != "Value" || selector.X.(*ast.Ident).Name != r.failpointName {
+		if _, ok := arg.Type.(*ast.Ellipsis); ok {
 			return false, nil, fmt.Errorf("failpoint.InjectContext: invalid signature in %s", r.pos(call.Pos()))
 		}
+		// func(val T) {...} is converted by failpoint.EvalContextAs[T](...),
+		// the closure is skipped if the value is not T.
+		if !r.isValueType(arg.Type) {
+			checkCall.Fun = &ast.IndexExpr{
+				X:     r.failpointSelector(call.Pos(), evalCtxAsFunction),
+				Index: arg.Type,
+			}
+		}
 		argName = arg.Names[0]
 	} else {
 		argName = ast.NewIdent("_")
@@ -246,10 +263,7 @@ func (r *Rewriter) rewriteInjectCall(call *ast.CallExpr) (bool, ast.Stmt, error)
 	fnArgs = append(fnArgs, call.Args[1:]...)
 	fnCall := &ast.ExprStmt{
 		X: &ast.CallExpr{
-			Fun: &ast.SelectorExpr{
-				X:   &ast.Ident{NamePos: call.Pos(), Name: r.failpointName},
-				Sel: ast.NewIdent(callFunction),
-			},
+			Fun:  r.failpointSelector(call.Pos(), callFunction),
 			Args: fnArgs,
 		},
 	}
@@ -264,12 +278,18 @@ func (r *Rewriter) rewriteBreak(call *ast.CallExpr) (bool, ast.Stmt, error) {
 	if len(call.Args) > 0 {
 		label := call.Args[0].(*ast.BasicLit).Value
 		label = strings.Trim(label, "`\"")
+		if err := r.checkBranch(call, "Break", label, false); err != nil {
+			return false, nil, err
+		}
 		stmt = &ast.BranchStmt{
 			TokPos: call.Pos(),
 			Tok:    token.BREAK,
 			Label:  ast.NewIdent(label),
 		}
 	} else {
+		if err := r.checkBranch(call, "Break", "", false); err != nil {
+			return false, nil, err
+		}
 		stmt = &ast.BranchStmt{
 			TokPos: call.Pos(),
 			Tok:    token.BREAK,
@@ -286,12 +306,18 @@ func (r *Rewriter) rewriteContinue(call *ast.CallExpr) (bool, ast.Stmt, error) {
 	if len(call.Args) > 0 {
 		label := call.Args[0].(*ast.BasicLit).Value
 		label = strings.Trim(label, "`\"")
+		if err := r.checkBranch(call, "Continue", label, true); err != nil {
+			return false, nil, err
+		}
 		stmt = &ast.BranchStmt{
 			TokPos: call.Pos(),
 			Tok:    token.CONTINUE,
 			Label:  ast.NewIdent(label),
 		}
 	} else {
+		if err := r.checkBranch(call, "Continue", "", true); err != nil {
+			return false, nil, err
+		}
 		stmt = &ast.BranchStmt{
 			TokPos: call.Pos(),
 			Tok:    token.CONTINUE,
@@ -336,9 +362,224 @@ func (r *Rewriter) rewriteFallthrough(call *ast.CallExpr) (bool, ast.Stmt, error
 }
 
 func (r *Rewriter) rewriteReturn(call *ast.CallExpr) (bool, ast.Stmt, error) {
+	if err := r.checkReturn(call); err != nil {
+		return false, nil, err
+	}
 	stmt := &ast.ReturnStmt{
 		Return:  call.Pos(),
 		Results: call.Args,
 	}
 	return true, stmt, nil
 }
+
+// checkBranch checks the `break` or `continue` statement has a target in the
+// enclosing function, the target must be a loop if loop is true.
+func (r *Rewriter) checkBranch(call *ast.CallExpr, marker, label string, loop bool) error {
+	scope := r.scope()
+	if scope == nil {
+		return nil
+	}
+	for i := len(scope.targets) - 1; i >= 0; i-- {
+		target := scope.targets[i]
+		if label == "" && (target.loop || !loop) {
+			return nil
+		}
+		if label != "" && target.label == label {
+			if loop && !target.loop {
+				return fmt.Errorf("failpoint.%s: label %s is not a loop in %s", marker, label, r.pos(call.Pos()))
+			}
+			return nil
+		}
+	}
+	if label != "" {
+		return fmt.Errorf("failpoint.%s: unknown label %s in %s", marker, label, r.pos(call.Pos()))
+	}
+	if loop {
+		return fmt.Errorf("failpoint.%s: no enclosing loop in %s", marker, r.pos(call.Pos()))
+	}
+	return fmt.Errorf("failpoint.%s: no enclosing loop, switch or select in %s", marker, r.pos(call.Pos()))
+}
+
+// checkReturn checks the results of the `return` statement match the signature
+// of the enclosing function, which must not be run by a `go` or `defer` statement.
+func (r *Rewriter) checkReturn(call *ast.CallExpr) error {
+	scope := r.scope()
+	if scope == nil {
+		return nil
+	}
+	if scope.closure != "" {
+		return fmt.Errorf("failpoint.Return: return from the %s closure instead of the enclosing function in %s", scope.closure, r.pos(call.Pos()))
+	}
+	want, named := 0, false
+	if scope.results != nil {
+		for _, field := range scope.results.List {
+			if len(field.Names) == 0 {
+				want++
+			} else {
+				want += len(field.Names)
+				named = true
+			}
+		}
+	}
+	got := len(call.Args)
+	switch {
+	case got == want:
+	case got == 0 && named:
+		// return with the named results
+	case got == 1 && want > 1 && isCallExpr(call.Args[0]):
+		// return with the results of a function call, e.g. `failpoint.Return(fn())`
+	default:
+		return fmt.Errorf("failpoint.Return: expect %d results but got %d in %s", want, got, r.pos(call.Pos()))
+	}
+	return nil
+}
+
+func isCallExpr(expr ast.Expr) bool {
+	if paren, ok := expr.(*ast.ParenExpr); ok {
+		return isCallExpr(paren.X)
+	}
+	_, ok := expr.(*ast.CallExpr)
+	return ok
+}
+
+// rewriteOverride rewrites the expression marker in place, the value of the
+// failpoint is used if it is enabled, otherwise the original expression.
+func (r *Rewriter) rewriteOverride(call *ast.CallExpr) error {
+	if len(call.Args) != 2 {
+		return fmt.Errorf("failpoint.Override: expect 2 arguments but got %v in %s", len(call.Args), r.pos(call.Pos()))
+	}
+
+	// failpoint.Override("name", expr)
+	//    |
+	//    v
+	// failpoint.EvalOverride(_curpkg_("name"), expr)
+	fpnameExtendCall := &ast.CallExpr{
+		Fun:  ast.NewIdent(ExtendPkgName),
+		Args: []ast.Expr{call.Args[0]},
+	}
+	fun := r.failpointSelector(call.Pos(), overrideFunction)
+	if index, ok := call.Fun.(*ast.IndexExpr); ok {
+		fun = &ast.IndexExpr{X: fun, Index: index.Index}
+	}
+	call.Fun = fun
+	call.Args = []ast.Expr{fpnameExtendCall, call.Args[1]}
+	r.rewritten = true
+	return nil
+}
+
+// rewriteSelect rewrites the select statement which has a case marked by
+// `failpoint.Case` or `failpoint.After`. The statement is wrapped in a block
+// which evaluates the failpoint once, the marked case is chosen if the failpoint
+// is enabled and the channels of the other cases are replaced by nil. The nil
+// block is returned if no case is marked.
+func (r *Rewriter) rewriteSelect(stmt *ast.SelectStmt) (*ast.BlockStmt, error) {
+	var marked *ast.CallExpr
+	var markedName string
+	var chans []*ast.Expr
+	for _, clause := range stmt.Body.List {
+		ch := commChan(clause.(*ast.CommClause).Comm)
+		if ch == nil {
+			continue
+		}
+		chans = append(chans, ch)
+		call, ok := (*ch).(*ast.CallExpr)
+		if !ok {
+			continue
+		}
+		name, ok := r.markerName(uninstantiated(call.Fun))
+		if !ok || (name != caseMarker && name != afterMarker) {
+			continue
+		}
+		if marked != nil {
+			return nil, fmt.Errorf("failpoint.%s: only one case of a select can be marked in %s", name, r.pos(call.Pos()))
+		}
+		expected := 2
+		if name == afterMarker {
+			expected = 1
+		}
+		if len(call.Args) != expected {
+			return nil, fmt.Errorf("failpoint.%s: expect %d arguments but got %v in %s", name, expected, len(call.Args), r.pos(call.Pos()))
+		}
+		marked, markedName = call, name
+	}
+	if marked == nil {
+		return nil, nil
+	}
+
+	// select {
+	// case v := <-ch1:
+	// case ch2 <- v:
+	// case <-failpoint.Case("name", ch3):
+	// }
+	//    |
+	//    v
+	// {
+	//     _sel_ := failpoint.EvalSelect(_curpkg_("name"))
+	//     select {
+	//     case v := <-failpoint.SelectOther(_sel_, ch1):
+	//     case failpoint.SelectOther(_sel_, ch2) <- v:
+	//     case <-failpoint.SelectCase(_sel_, ch3):
+	//     }
+	// }
+	for _, ch := range chans {
+		if *ch == marked {
+			if markedName == caseMarker {
+				*ch = &ast.CallExpr{
+					Fun:  r.failpointSelector(marked.Pos(), selectCaseFunc),
+					Args: []ast.Expr{ast.NewIdent("_sel_"), marked.Args[1]},
+				}
+			} else {
+				*ch = &ast.CallExpr{
+					Fun:  r.failpointSelector(marked.Pos(), selectAfterFunc),
+					Args: []ast.Expr{ast.NewIdent("_sel_")},
+				}
+			}
+			continue
+		}
+		*ch = &ast.CallExpr{
+			Fun:  r.failpointSelector((*ch).Pos(), selectOtherFunc),
+			Args: []ast.Expr{ast.NewIdent("_sel_"), *ch},
+		}
+	}
+
+	fpnameExtendCall := &ast.CallExpr{
+		Fun:  ast.NewIdent(ExtendPkgName),
+		Args: []ast.Expr{marked.Args[0]},
+	}
+	init := &ast.AssignStmt{
+		Lhs: []ast.Expr{ast.NewIdent("_sel_")},
+		Tok: token.DEFINE,
+		Rhs: []ast.Expr{&ast.CallExpr{
+			Fun:  r.failpointSelector(marked.Pos(), selectFunction),
+			Args: []ast.Expr{fpnameExtendCall},
+		}},
+	}
+	return &ast.BlockStmt{
+		Lbrace: stmt.Pos(),
+		List:   []ast.Stmt{init, stmt},
+		Rbrace: stmt.End(),
+	}, nil
+}
+
+// commChan returns the channel expression of the communication clause, it
+// returns nil for the default clause.
+func commChan(comm ast.Stmt) *ast.Expr {
+	var recv ast.Expr
+	switch v := comm.(type) {
+	case *ast.SendStmt:
+		return &v.Chan
+	case *ast.ExprStmt:
+		recv = v.X
+	case *ast.AssignStmt:
+		if len(v.Rhs) != 1 {
+			return nil
+		}
+		recv = v.Rhs[0]
+	default:
+		return nil
+	}
+	if unary, ok := recv.(*ast.UnaryExpr); ok && unary.Op == token.ARROW {
+		return &unary.X
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// BuildTag is the build tag which selects the variants with active failpoints
+	BuildTag = "failpoint"
+	// OverlayFileName is the overlay file written to the module root by `failpoint-ctl generate`,
+	// which removes the source files with failpoints from the builds with the BuildTag
+	OverlayFileName = "failpoint_overlay.json"
+
+	generatedOnSuffix = "_failpoint_on"
+	// generatedBindingFileName is the binding file of the variants with active failpoints
+	generatedBindingFileName = "failpoint_binding" + generatedOnSuffix + ".go"
+	generatedHeader          = "// Code generated by failpoint-ctl generate. DO NOT EDIT.\n"
+)
+
+// knownOS and knownArch are the GOOS and GOARCH which constrain a file by its
+// name, see go/build
+var (
+	knownOS = map[string]bool{
+		"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true,
+		"hurd": true, "illumos": true, "ios": true, "js": true, "linux": true, "nacl": true,
+		"netbsd": true, "openbsd": true, "plan9": true, "solaris": true, "wasip1": true,
+		"windows": true, "zos": true,
+	}
+	knownArch = map[string]bool{
+		"386": true, "amd64": true, "amd64p32": true, "arm": true, "armbe": true, "arm64": true,
+		"arm64be": true, "loong64": true, "mips": true, "mipsle": true, "mips64": true,
+		"mips64le": true, "mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true,
+		"ppc64le": true, "riscv": true, "riscv64": true, "s390": true, "s390x": true,
+		"sparc": true, "sparc64": true, "wasm": true,
+	}
+)
+
+// Generator generates the failpoint variants of the Go files with markers, so the
+// failpoints are enabled by the BuildTag instead of rewriting the files. For each
+// source file `foo.go`, `foo_failpoint_on.go` is the rewritten file built with the
+// BuildTag, and the source file itself is built without it, whose markers are no-ops.
+//
+// The source files are never modified, so they can not be excluded from the builds
+// with the BuildTag by a build constraint, and `-tags failpoint` alone fails with the
+// declarations redeclared by the variants. Instead, the source files are removed by
+// the overlay file in the root of the module, see OverlayFileName. Its paths are
+// relative to the module root, where the packages are built with the failpoints:
+//
+//	go test -tags failpoint -overlay failpoint_overlay.json ./...
+//
+// The generated files refer to the lines of the source files by line directives.
+type Generator struct {
+	path      string
+	flat      bool
+	generated []string
+	removed   []string
+	// sources are the source files which the variants are generated from
+	sources []string
+}
+
+// NewGenerator returns a generator of the source files under the path
+func NewGenerator(path string) *Generator {
+	return &Generator{path: path}
+}
+
+// SetRecursive sets whether the source files in the subdirectories of the path
+// are generated, it is true by default
+func (g *Generator) SetRecursive(b bool) {
+	g.flat = !b
+}
+
+// Generated returns the files written by the last Generate call
+func (g *Generator) Generated() []string {
+	return g.generated
+}
+
+// Removed returns the generated files removed by the last Generate call, whose
+// source files do not exist or have no markers any more
+func (g *Generator) Removed() []string {
+	return g.removed
+}
+
+// Generate generates the variants of the source files under the path and the
+// overlay file, the files which are up to date are not written again.
+func (g *Generator) Generate() error {
+	g.generated, g.removed, g.sources = nil, nil, nil
+	walker := NewRewriter(g.path)
+	walker.SetRecursive(!g.flat)
+	dirs, err := walker.goFileDirs()
+	if err != nil {
+		return err
+	}
+	for _, files := range dirs {
+		if err := g.generateDir(files); err != nil {
+			return err
+		}
+	}
+	return g.generateOverlay()
+}
+
+// generateOverlay updates the overlay file of the module with the source files
+// under the path, the entries of the other source files of the module are kept.
+// The overlay file is removed if there is no source file in the module.
+func (g *Generator) generateOverlay() error {
+	absPath, err := filepath.Abs(g.path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return err
+	}
+	dir := absPath
+	if !info.IsDir() {
+		dir = filepath.Dir(absPath)
+	}
+	root := moduleRoot(dir)
+	path := filepath.Join(root, OverlayFileName)
+	// inScope returns whether the source file is walked by Generate
+	inScope := func(file string) bool {
+		switch {
+		case !info.IsDir():
+			return file == absPath
+		case g.flat:
+			return filepath.Dir(file) == dir
+		default:
+			return file == dir || strings.HasPrefix(file, dir+string(filepath.Separator))
+		}
+	}
+
+	overlay := &Overlay{}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, overlay); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	replace := map[string]string{}
+	for rel := range overlay.Replace {
+		file := filepath.Join(root, filepath.FromSlash(rel))
+		if _, err := os.Stat(file); err == nil && !inScope(file) {
+			replace[rel] = ""
+		}
+	}
+	for _, source := range g.sources {
+		abs, err := filepath.Abs(source)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err != nil {
+			return err
+		}
+		// The empty replacement removes the file from the builds
+		replace[filepath.ToSlash(rel)] = ""
+	}
+
+	if len(replace) == 0 {
+		if err := os.Remove(path); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		g.removed = append(g.removed, path)
+		return nil
+	}
+	data, err := json.MarshalIndent(&Overlay{Replace: replace}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return g.writeGenerated(path, append(data, '\n'))
+}
+
+// moduleRoot returns the directory of the go.mod which the directory belongs to,
+// or the directory itself if it is not in a module
+func moduleRoot(dir string) string {
+	for d := dir; ; {
+		if info, err := os.Stat(filepath.Join(d, "go.mod")); err == nil && !info.IsDir() {
+			return d
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return dir
+		}
+		d = parent
+	}
+}
+
+// generateDir generates the variants of the source files of a directory, and
+// removes the stale generated files of the directory
+func (g *Generator) generateDir(files []string) error {
+	wanted := map[string]bool{}
+	bindings := map[string]string{}
+	for _, path := range files {
+		if isGeneratedName(filepath.Base(path)) {
+			continue
+		}
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		// The files which do not mention the package path are not parsed at all
+		if !bytes.Contains(src, []byte(packagePath)) {
+			continue
+		}
+		on, err := onConstraint(path, src)
+		if err != nil {
+			return err
+		}
+
+		onContent, pkgName, rewritten, err := generateOn(path, src, on)
+		if err != nil {
+			return err
+		}
+		if !rewritten {
+			continue
+		}
+		bindings[filepath.Join(filepath.Dir(path), generatedBindingName(pkgName))] = pkgName
+		variant := generatedName(path, generatedOnSuffix)
+		wanted[variant] = true
+		if err := g.writeGenerated(variant, onContent); err != nil {
+			return err
+		}
+		g.sources = append(g.sources, path)
+	}
+	bindingPaths := make([]string, 0, len(bindings))
+	for path := range bindings {
+		bindingPaths = append(bindingPaths, path)
+	}
+	sort.Strings(bindingPaths)
+	for _, path := range bindingPaths {
+		wanted[path] = true
+		content := generatedHeader + "\n//go:build " + BuildTag + "\n" + bindingContent(bindings[path])
+		if err := g.writeGenerated(path, []byte(content)); err != nil {
+			return err
+		}
+	}
+
+	// The generated files may be in a directory without any source file
+	entries, err := os.ReadDir(filepath.Dir(files[0]))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(filepath.Dir(files[0]), entry.Name())
+		if entry.IsDir() || !isGeneratedName(entry.Name()) || wanted[path] {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(content, []byte(generatedHeader)) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		g.removed = append(g.removed, path)
+	}
+	return nil
+}
+
+// writeGenerated writes the generated file if its content is changed
+func (g *Generator) writeGenerated(path string, content []byte) error {
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, content) {
+		return nil
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return err
+	}
+	g.generated = append(g.generated, path)
+	return nil
+}
+
+// generatedBindingName returns the name of the generated binding file of the
+// package, the external test package has its own binding file
+func generatedBindingName(pkgName string) string {
+	if strings.HasSuffix(pkgName, "_test") {
+		return strings.TrimSuffix(generatedBindingFileName, ".go") + "_test.go"
+	}
+	return generatedBindingFileName
+}
+
+// isGeneratedName returns whether the file name is of a generated variant or binding file
+func isGeneratedName(name string) bool {
+	stem := strings.TrimSuffix(strings.TrimSuffix(name, ".go"), "_test")
+	elems := strings.Split(stem, "_")
+	for i := 1; i+1 < len(elems); i++ {
+		if elems[i] == "failpoint" && elems[i+1] == "on" {
+			return true
+		}
+	}
+	return false
+}
+
+// generatedName returns the path of the variant of the source file. The suffix
+// is inserted before the `_test`, GOOS and GOARCH elements of the name, so the
+// variant is constrained like the source file.
+func generatedName(path, suffix string) string {
+	stem := strings.TrimSuffix(filepath.Base(path), ".go")
+	tail := ".go"
+	if strings.HasSuffix(stem, "_test") {
+		stem, tail = strings.TrimSuffix(stem, "_test"), "_test.go"
+	}
+	elems := strings.Split(stem, "_")
+	n, keep := len(elems), 0
+	switch {
+	case n >= 3 && knownOS[elems[n-2]] && knownArch[elems[n-1]]:
+		keep = 2
+	case n >= 2 && (knownOS[elems[n-1]] || knownArch[elems[n-1]]):
+		keep = 1
+	}
+	if keep > 0 {
+		tail = "_" + strings.Join(elems[n-keep:], "_") + tail
+		stem = strings.Join(elems[:n-keep], "_")
+	}
+	return filepath.Join(filepath.Dir(path), stem+suffix+tail)
+}
+
+// onConstraint returns the build constraint line of the variant with the BuildTag,
+// the other conditions of the `//go:build` line of the source file are kept
+func onConstraint(path string, src []byte) (string, error) {
+	expr := constraint.Expr(&constraint.TagExpr{Tag: BuildTag})
+	if line, found := buildLine(src); found {
+		source, err := constraint.Parse(line)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", path, err)
+		}
+		expr = &constraint.AndExpr{X: expr, Y: source}
+	}
+	return "//go:build " + expr.String(), nil
+}
+
+// buildLine returns the `//go:build` line before the package clause
+func buildLine(src []byte) (string, bool) {
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if constraint.IsGoBuild(line) {
+			return line, true
+		}
+		if line != "" && !strings.HasPrefix(line, "//") {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// blankConstraints blanks the build constraint lines before the package clause of
+// the content, so the lines are not shifted
+func blankConstraints(content []byte) []byte {
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if constraint.IsGoBuild(trimmed) || constraint.IsPlusBuild(trimmed) {
+			lines[i] = ""
+		} else if trimmed != "" && !strings.HasPrefix(trimmed, "//") {
+			break
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// variantContent returns the content of a generated variant with the build
+// constraint line, its lines refer to the lines of the source file by the line
+// directive before them
+func variantContent(path string, content []byte, goBuild string) []byte {
+	header := generatedHeader + "\n" + goBuild + "\n\n//line " + filepath.Base(path) + ":1\n"
+	return append([]byte(header), blankConstraints(content)...)
+}
+
+// generateOn returns the content of the variant with the BuildTag, which is the
+// rewritten source file, and whether the source file has been rewritten
+func generateOn(path string, src []byte, goBuild string) ([]byte, string, bool, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, "", false, err
+	}
+	r := NewRewriter(path)
+	r.SetAllowNotChecked(true)
+	r.SetLineDirectives(true)
+	if err := r.rewriteFile(path, fset, file); err != nil {
+		return nil, "", false, err
+	}
+	if !r.rewritten {
+		return nil, file.Name.Name, false, nil
+	}
+	content, err := r.renderFile(path, fset, file, src, writeModeFile)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return variantContent(path, content, goBuild), file.Name.Name, true, nil
+}
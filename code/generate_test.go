@@ -0,0 +1,158 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pingcap/failpoint/code"
+)
+
+func TestGenerate(t *testing.T) {
+	// The generated packages are in their own module, whose root has the overlay file
+	generatePath, err := filepath.Abs("tmp/generate/")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(generatePath))
+	}()
+	write := func(name, content string) string {
+		path := filepath.Join(generatePath, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+	root, err := filepath.Abs("..")
+	require.NoError(t, err)
+	write("go.mod", "module example.com/generate\n\ngo 1.19\n\nrequire github.com/pingcap/failpoint v0.0.0\n\nreplace github.com/pingcap/failpoint => "+root+"\n")
+	sum, err := os.ReadFile(filepath.Join(root, "go.sum"))
+	require.NoError(t, err)
+	write("go.sum", string(sum))
+
+	sourceContent := `//go:build !plan9
+
+package sub
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func Foo() int {
+	failpoint.Inject("foo", func(val failpoint.Value) {
+		failpoint.Return(val.(int))
+	})
+	return 0
+}
+`
+	source := write("sub/foo.go", sourceContent)
+	linuxSource := write("sub/bar_linux.go", `package sub
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func Bar() int {
+	failpoint.Inject("bar", nil)
+	return Foo()
+}
+`)
+	write("plain.go", "package generate\n\nfunc Plain() {}\n")
+
+	// The package is generated in a subdirectory of the module
+	generator := code.NewGenerator(filepath.Join(generatePath, "sub"))
+	require.NoError(t, generator.Generate())
+	on := filepath.Join(generatePath, "sub", "foo_failpoint_on.go")
+	linuxOn := filepath.Join(generatePath, "sub", "bar_failpoint_on_linux.go")
+	binding := filepath.Join(generatePath, "sub", "failpoint_binding_failpoint_on.go")
+	overlay := filepath.Join(generatePath, code.OverlayFileName)
+	require.ElementsMatch(t, []string{on, linuxOn, binding, overlay}, generator.Generated())
+
+	content, err := os.ReadFile(on)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(content), "// Code generated by failpoint-ctl generate. DO NOT EDIT.\n\n//go:build failpoint && !plan9\n\n//line foo.go:1\n"))
+	require.Contains(t, string(content), "failpoint.Eval(_curpkg_(\"foo\"))")
+	content, err = os.ReadFile(linuxOn)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "\n//go:build failpoint\n")
+	content, err = os.ReadFile(binding)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "//go:build failpoint\n")
+	content, err = os.ReadFile(overlay)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Replace": {"sub/bar_linux.go": "", "sub/foo.go": ""}}`, string(content))
+	// The source files are never modified
+	content, err = os.ReadFile(source)
+	require.NoError(t, err)
+	require.Equal(t, sourceContent, string(content))
+
+	// The source files are built without the tag, and replaced by the variants
+	// with the tag and the overlay in the module root
+	vet := func(args ...string) (string, error) {
+		cmd := exec.Command("go", append(append([]string{"vet"}, args...), "./...")...)
+		cmd.Dir = generatePath
+		cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod")
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	for _, args := range [][]string{nil, {"-tags=failpoint", "-overlay=" + code.OverlayFileName}} {
+		out, err := vet(args...)
+		require.NoError(t, err, out)
+	}
+	// The tag alone builds both the source files and the variants
+	out, err := vet("-tags=failpoint")
+	require.Error(t, err)
+	require.Contains(t, out, "redeclared")
+
+	// The overlay file keeps the source files generated by the other paths
+	other := write("other/other.go", `package other
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func Other() {
+	failpoint.Inject("other", nil)
+}
+`)
+	otherGenerator := code.NewGenerator(filepath.Dir(other))
+	require.NoError(t, otherGenerator.Generate())
+	content, err = os.ReadFile(overlay)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Replace": {"other/other.go": "", "sub/bar_linux.go": "", "sub/foo.go": ""}}`, string(content))
+
+	// The up-to-date files are not written again, and the stale ones are removed
+	require.NoError(t, generator.Generate())
+	require.Empty(t, generator.Generated())
+	require.NoError(t, os.Remove(source))
+	require.NoError(t, generator.Generate())
+	require.Equal(t, []string{overlay}, generator.Generated())
+	require.Equal(t, []string{on}, generator.Removed())
+	require.NoError(t, os.Remove(linuxSource))
+	require.NoError(t, generator.Generate())
+	require.ElementsMatch(t, []string{linuxOn, binding}, generator.Removed())
+	content, err = os.ReadFile(overlay)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Replace": {"other/other.go": ""}}`, string(content))
+	require.NoError(t, os.Remove(other))
+	require.NoError(t, otherGenerator.Generate())
+	require.Contains(t, otherGenerator.Removed(), overlay)
+	_, err = os.Stat(filepath.Join(generatePath, "plain.go"))
+	require.NoError(t, err)
+}
@@ -0,0 +1,220 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitExcludes are the patterns of the generated files, which are added to the
+// `info/exclude` of the git repository so they are never shown as untracked
+var gitExcludes = []string{
+	"*" + failpointStashFileSuffix,
+	failpointLineMapDirName + "/",
+	failpointBindingFileName,
+	failpointJournalFileName,
+}
+
+// runGit runs the git command in the directory and returns its output
+func runGit(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// splitNul splits the output of a git command with the `-z` option
+func splitNul(out []byte) []string {
+	var names []string
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// gitExcludeHeader is the first line of the patterns appended to the exclude file
+const gitExcludeHeader = "# generated by failpoint-ctl"
+
+// hideFromGit excludes the generated files in the git repository of the root,
+// and marks the rewritten files tracked by git as skip-worktree, so that they
+// are not shown by `git status` or staged by `git add`. The appended patterns
+// and the marked files are recorded in the journal, they are reverted by the
+// Restorer.
+func hideFromGit(root string, files []string) error {
+	excludePath, err := runGit(root, "rev-parse", "--git-path", "info/exclude")
+	if err != nil {
+		return err
+	}
+	exclude := strings.TrimSpace(string(excludePath))
+	if !filepath.IsAbs(exclude) {
+		exclude = filepath.Join(root, exclude)
+	}
+	content, err := os.ReadFile(exclude)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existing := map[string]bool{}
+	for _, line := range strings.Split(string(content), "\n") {
+		existing[strings.TrimSpace(line)] = true
+	}
+	var missing []string
+	for _, pattern := range gitExcludes {
+		if !existing[pattern] {
+			missing = append(missing, pattern)
+		}
+	}
+	if len(missing) > 0 {
+		lines := append([]string{gitExcludeHeader}, missing...)
+		if err := appendJournalLines(root, journalGitExclude, exclude, nil, lines); err != nil {
+			return err
+		}
+		if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+			content = append(content, '\n')
+		}
+		content = append(content, strings.Join(lines, "\n")+"\n"...)
+		if err := os.MkdirAll(filepath.Dir(exclude), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(exclude, content, 0644); err != nil {
+			return err
+		}
+	}
+
+	absFiles := make([]string, 0, len(files))
+	for _, file := range files {
+		absFile, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		absFiles = append(absFiles, absFile)
+	}
+	out, err := runGit(root, append([]string{"ls-files", "-z", "--full-name", "--"}, absFiles...)...)
+	if err != nil {
+		return err
+	}
+	tracked := splitNul(out)
+	if len(tracked) == 0 {
+		return nil
+	}
+	top, err := runGit(root, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	var marked []string
+	for _, name := range tracked {
+		file := filepath.Join(strings.TrimSpace(string(top)), filepath.FromSlash(name))
+		if err := appendJournal(root, journalSkipWorktree, file, nil); err != nil {
+			return err
+		}
+		marked = append(marked, file)
+	}
+	_, err = runGit(root, append([]string{"update-index", "--skip-worktree", "--"}, marked...)...)
+	return err
+}
+
+// revealToGit removes the patterns appended to the exclude file and unmarks the
+// files marked as skip-worktree by hideFromGit, which are recorded in the journal
+// of the root
+func revealToGit(root string) error {
+	entries, err := readJournal(root)
+	if err != nil {
+		return err
+	}
+	var marked []string
+	for _, entry := range entries {
+		switch entry.Op {
+		case journalGitExclude:
+			if err := removeGitExcludes(entry.Path, entry.Lines); err != nil {
+				return err
+			}
+		case journalSkipWorktree:
+			marked = append(marked, entry.Path)
+		}
+	}
+	if len(marked) == 0 {
+		return nil
+	}
+	_, err = runGit(root, append([]string{"update-index", "--no-skip-worktree", "--"}, marked...)...)
+	return err
+}
+
+// removeGitExcludes removes the lines appended by hideFromGit from the exclude
+// file, the file is left as it is if the lines have been removed or modified
+func removeGitExcludes(exclude string, lines []string) error {
+	content, err := os.ReadFile(exclude)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	block := []byte(strings.Join(lines, "\n") + "\n")
+	idx := bytes.Index(content, block)
+	if idx < 0 || (idx > 0 && content[idx-1] != '\n') {
+		return nil
+	}
+	content = append(content[:idx:idx], content[idx+len(block):]...)
+	return os.WriteFile(exclude, content, 0644)
+}
+
+// StagedFailpointFiles returns the files staged in the git repository of the
+// directory which are generated by `failpoint-ctl enable`, or contain the code
+// rewritten from the markers. It is used to check the commits, e.g. in a git
+// pre-commit hook, so that the rewritten tree is never committed by accident.
+// The files generated by `failpoint-ctl generate` are not reported.
+func StagedFailpointFiles(dir string) ([]string, error) {
+	out, err := runGit(dir, "diff", "--cached", "--name-only", "--relative", "-z", "--diff-filter=ACMR")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range splitNul(out) {
+		base := filepath.Base(name)
+		if strings.HasSuffix(base, failpointStashFileSuffix) ||
+			isLineMapFile(name) ||
+			base == failpointBindingFileName ||
+			base == failpointJournalFileName {
+			files = append(files, name)
+			continue
+		}
+		if !strings.HasSuffix(base, ".go") {
+			continue
+		}
+		content, err := runGit(dir, "show", ":./"+name)
+		if err != nil {
+			return nil, err
+		}
+		// The variants generated by `failpoint-ctl generate` are meant to be committed
+		if bytes.HasPrefix(content, []byte(generatedHeader)) {
+			continue
+		}
+		if bytes.Contains(content, []byte(ExtendPkgName+"(")) {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
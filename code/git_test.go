@@ -0,0 +1,100 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/failpoint/code"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	original := `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", nil)
+}
+`
+	repo := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return string(out)
+	}
+	git("init", "-q")
+	excludePath := filepath.Join(repo, ".git", "info", "exclude")
+	require.NoError(t, os.MkdirAll(filepath.Dir(excludePath), 0755))
+	require.NoError(t, os.WriteFile(excludePath, []byte("# user patterns\n*.log"), 0644))
+	pkgDir := filepath.Join(repo, "pkg")
+	require.NoError(t, os.MkdirAll(pkgDir, 0755))
+	fileName := filepath.Join(pkgDir, "git.go")
+	require.NoError(t, os.WriteFile(fileName, []byte(original), 0644))
+	git("add", "-A")
+	git("commit", "-q", "-m", "init")
+
+	// The rewriting is hidden from git
+	rewriter := code.NewRewriter(pkgDir)
+	rewriter.SetGit(true)
+	require.NoError(t, rewriter.Rewrite())
+	require.Empty(t, git("status", "--porcelain"))
+	require.Equal(t, "S pkg/git.go\n", git("ls-files", "-v"))
+	exclude, err := os.ReadFile(excludePath)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(exclude), "# user patterns\n*.log\n# generated by failpoint-ctl\n"))
+	require.True(t, strings.HasSuffix(string(exclude), "\n__failpoint_journal__\n"))
+	staged, err := code.StagedFailpointFiles(repo)
+	require.NoError(t, err)
+	require.Empty(t, staged)
+
+	// The generated files and the rewritten content are reported if staged
+	git("add", "-f", "pkg/binding__failpoint_binding__.go")
+	rewritten, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(pkgDir, "copied.go"), rewritten, 0644))
+	git("add", "pkg/copied.go")
+	// The files generated by `failpoint-ctl generate` are not reported
+	generated := "// Code generated by failpoint-ctl generate. DO NOT EDIT.\n\n" + string(rewritten)
+	require.NoError(t, os.WriteFile(filepath.Join(pkgDir, "git_failpoint_on.go"), []byte(generated), 0644))
+	git("add", "pkg/git_failpoint_on.go")
+	staged, err = code.StagedFailpointFiles(pkgDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"binding__failpoint_binding__.go", "copied.go"}, staged)
+	git("reset", "-q")
+	require.NoError(t, os.Remove(filepath.Join(pkgDir, "copied.go")))
+	require.NoError(t, os.Remove(filepath.Join(pkgDir, "git_failpoint_on.go")))
+
+	require.NoError(t, code.NewRestorer(pkgDir).Restore())
+	require.Empty(t, git("status", "--porcelain"))
+	require.Equal(t, "H pkg/git.go\n", git("ls-files", "-v"))
+	// The appended patterns are removed from the exclude file
+	exclude, err = os.ReadFile(excludePath)
+	require.NoError(t, err)
+	require.Equal(t, "# user patterns\n*.log\n", string(exclude))
+}
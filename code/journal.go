@@ -0,0 +1,220 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// failpointJournalFileName is the journal at the root of the rewrite path
+const failpointJournalFileName = "__failpoint_journal__"
+
+// The operations recorded in the journal
+const (
+	// journalBinding is recorded before a binding file is created
+	journalBinding = "binding"
+	// journalStash is recorded before a file is renamed to the stash file
+	journalStash = "stash"
+	// journalRewritten is recorded after a file and its line map are written
+	journalRewritten = "rewritten"
+	// journalSkipWorktree is recorded before a file is marked as skip-worktree in git
+	journalSkipWorktree = "skip-worktree"
+	// journalGitExclude is recorded before the lines are appended to the exclude file of git
+	journalGitExclude = "git-exclude"
+)
+
+// journalEntry is a line of the journal, which is appended and synced before
+// the step it records, so an interrupted `failpoint-ctl enable` can be rolled
+// back by the entries. The path is relative to the root of the rewrite path.
+type journalEntry struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Hash is the SHA-256 of the original content of a stashed file
+	Hash string `json:"hash,omitempty"`
+	// Lines are the lines appended to the exclude file of git
+	Lines []string `json:"lines,omitempty"`
+}
+
+// journalRoot returns the directory of the journal for the rewrite path
+func journalRoot(path string) string {
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		return filepath.Dir(path)
+	}
+	return path
+}
+
+// journalRoots returns the directories of the journals under the path, including
+// the journal of the path itself, e.g. the journals of the sub paths enabled before
+func journalRoots(path string) ([]string, error) {
+	var roots []string
+	root := filepath.Clean(journalRoot(path))
+	if _, err := os.Stat(filepath.Join(root, failpointJournalFileName)); err == nil {
+		roots = append(roots, root)
+	}
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		dir := filepath.Dir(file)
+		if !info.IsDir() && info.Name() == failpointJournalFileName && dir != root {
+			roots = append(roots, dir)
+		}
+		return nil
+	})
+	return roots, err
+}
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// journalMu serializes the entries appended by the concurrent rewriting
+var journalMu sync.Mutex
+
+// appendJournal appends the entry of the file to the journal of the root
+func appendJournal(root, op, path string, content []byte) error {
+	return appendJournalLines(root, op, path, content, nil)
+}
+
+// appendJournalLines appends the entry of the file with the lines to the journal of the root
+func appendJournalLines(root, op, path string, content []byte, lines []string) error {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil {
+		return err
+	}
+	entry := journalEntry{Op: op, Path: filepath.ToSlash(rel), Lines: lines}
+	if content != nil {
+		entry.Hash = contentHash(content)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(root, failpointJournalFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readJournal reads the entries of the journal of the root, it returns nil if
+// the journal does not exist. The incomplete last entry is ignored, it is left
+// by an interruption before the step it records.
+func readJournal(root string) ([]journalEntry, error) {
+	f, err := os.Open(filepath.Join(root, failpointJournalFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	var lastErr error
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			lastErr = fmt.Errorf("invalid journal %s: %v", f.Name(), err)
+			continue
+		}
+		entry.Path = filepath.Join(root, filepath.FromSlash(entry.Path))
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// rollbackJournal rolls back the files which are stashed but not completely
+// rewritten according to the journal of the root, and removes the recorded
+// binding files. The stash files must match the hashes of the original contents.
+// The completely rewritten files are left to be restored with their modifications.
+func rollbackJournal(root string) error {
+	entries, err := readJournal(root)
+	if err != nil {
+		return err
+	}
+	rewritten := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Op == journalRewritten {
+			rewritten[entry.Path] = true
+		}
+	}
+	for _, entry := range entries {
+		switch entry.Op {
+		case journalBinding:
+			if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		case journalStash:
+			stashPath := entry.Path + failpointStashFileSuffix
+			content, err := os.ReadFile(stashPath)
+			if os.IsNotExist(err) {
+				// The file has not been renamed or has been restored
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if contentHash(content) != entry.Hash {
+				return fmt.Errorf("stash file %s does not match the journal", stashPath)
+			}
+			if rewritten[entry.Path] {
+				continue
+			}
+			if err := os.Rename(stashPath, entry.Path); err != nil {
+				return err
+			}
+			lineMap, err := lineMapPath(root, entry.Path)
+			if err != nil {
+				return err
+			}
+			if err := removeLineMapFile(lineMap); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lineDirectivePrefix is the prefix of the `//line file:line:col` directive
+const lineDirectivePrefix = "//line "
+
+// lineAnchor maps a line of the rewritten output to the line of the original file
+type lineAnchor struct {
+	out, orig int
+}
+
+// LineMap maps the lines of a rewritten file to the lines of its original file,
+// it is recorded by the rewriter and used to remap the coverage profiles.
+type LineMap struct {
+	// Original is the path of the original file, it is relative to the
+	// directory of the rewritten file if it is not absolute.
+	Original string `json:"original"`
+	// Lines[i] is the original line of the line i+1 reported by the compiler
+	// for the rewritten file, the line directives have been taken into account.
+	Lines []int `json:"lines"`
+	// Widths[i] is the length in bytes of the original line i+1
+	Widths []int `json:"widths"`
+	// TypeCheck is whether the file has been rewritten in the type-aware mode,
+	// the restorer rewrites the stashed file in the same mode.
+	TypeCheck bool `json:"type_check,omitempty"`
+}
+
+// formatFile writes the rewritten file to w and records the line map. If line
+// directives are enabled, `//line` directives are inserted in front of the lines
+// which have been shifted by the rewriting, so that the positions reported by
+// the compiler, the runtime and the coverage tools map back to the original file.
+func (r *Rewriter) formatFile(w io.Writer, fset *token.FileSet, file *ast.File, src []byte, filename string) error {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		return err
+	}
+	anchors := collectLineAnchors(fset, file, buf.Bytes())
+	output := buf.String()
+	if r.lineDirectives {
+		output = insertLineDirectives(output, anchors, filename)
+	}
+	r.lineMap = buildLineMap(output, anchors, src, filename)
+	_, err := io.WriteString(w, output)
+	return err
+}
+
+// collectLineAnchors parses the formatted output again and walks the rewritten
+// AST and the parsed AST in parallel. Every statement, declaration and closing
+// brace which comes from the original file is an anchor. It returns nil if the
+// two trees do not match, which means the lines can not be mapped reliably.
+func collectLineAnchors(fset *token.FileSet, file *ast.File, output []byte) []lineAnchor {
+	outFset := token.NewFileSet()
+	outFile, err := parser.ParseFile(outFset, "", output, parser.ParseComments)
+	if err != nil {
+		return nil
+	}
+	// A directive can not be inserted into a multi-line string or comment
+	unsafe := map[int]bool{}
+	markUnsafe := func(pos, end token.Pos) {
+		for l := outFset.Position(pos).Line + 1; l <= outFset.Position(end).Line; l++ {
+			unsafe[l] = true
+		}
+	}
+	ast.Inspect(outFile, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			markUnsafe(lit.Pos(), lit.End())
+		}
+		return true
+	})
+	for _, group := range outFile.Comments {
+		for _, c := range group.List {
+			markUnsafe(c.Pos(), c.End())
+		}
+	}
+
+	rewritten := lineNodes(file)
+	formatted := lineNodes(outFile)
+	if len(rewritten) != len(formatted) {
+		return nil
+	}
+
+	var anchors []lineAnchor
+	add := func(orig, out token.Pos) {
+		if !orig.IsValid() || !out.IsValid() || unsafe[outFset.Position(out).Line] {
+			return
+		}
+		anchors = append(anchors, lineAnchor{
+			out:  outFset.Position(out).Line,
+			orig: fset.Position(orig).Line,
+		})
+	}
+	for i, n := range rewritten {
+		m := formatted[i]
+		if reflect.TypeOf(n) != reflect.TypeOf(m) {
+			return nil
+		}
+		add(n.Pos(), m.Pos())
+		if block, ok := n.(*ast.BlockStmt); ok {
+			add(block.Rbrace, m.(*ast.BlockStmt).Rbrace)
+		}
+	}
+	// The first anchor of a line wins
+	sort.SliceStable(anchors, func(i, j int) bool { return anchors[i].out < anchors[j].out })
+	return anchors
+}
+
+// lineNodes returns the nodes which start a line in the source order
+func lineNodes(file *ast.File) []ast.Node {
+	var nodes []ast.Node
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.EmptyStmt:
+			// implicit empty statements are not printed
+		case ast.Stmt, ast.Decl, ast.Spec:
+			nodes = append(nodes, n)
+		}
+		return true
+	})
+	return nodes
+}
+
+// buildLineMap builds the line map of the output, the original lines of the
+// lines between two anchors are estimated by the distance to the previous anchor.
+func buildLineMap(output string, anchors []lineAnchor, src []byte, filename string) *LineMap {
+	m := &LineMap{Original: filename}
+	for _, line := range strings.Split(strings.TrimSuffix(string(src), "\n"), "\n") {
+		m.Widths = append(m.Widths, len(line))
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	// reported is the line number which the compiler assigns to the
+	// current line, and out is the line number without directives.
+	reported, out, next := 0, 0, 0
+	var prev *lineAnchor
+	for _, line := range lines {
+		if n, ok := parseLineDirective(line, filename); ok {
+			reported = n - 1
+			continue
+		}
+		reported++
+		out++
+		for next < len(anchors) && anchors[next].out <= out {
+			prev = &anchors[next]
+			next++
+		}
+		orig := out
+		if prev != nil {
+			orig = prev.orig + out - prev.out
+		}
+		for len(m.Lines) < reported {
+			m.Lines = append(m.Lines, 0)
+		}
+		// The first line reported as the same number wins
+		if m.Lines[reported-1] == 0 {
+			m.Lines[reported-1] = orig
+		}
+	}
+	// Fill the lines which are never reported, e.g. skipped by a line directive
+	for i := range m.Lines {
+		if m.Lines[i] == 0 {
+			m.Lines[i] = i + 1
+			if i > 0 {
+				m.Lines[i] = m.Lines[i-1] + 1
+			}
+		}
+	}
+	return m
+}
+
+// parseLineDirective returns the line number of a line directive which
+// is generated by the rewriter for the file.
+func parseLineDirective(line, filename string) (int, bool) {
+	prefix := lineDirectivePrefix + filename + ":"
+	if !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, ":1") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[len(prefix):], ":1"))
+	return n, err == nil
+}
+
+// insertLineDirectives inserts a `//line` directive in front of every anchored
+// line whose line number does not match the original one.
+func insertLineDirectives(output string, anchors []lineAnchor, filename string) string {
+	if len(anchors) == 0 {
+		return output
+	}
+	lines := strings.SplitAfter(output, "\n")
+	var b strings.Builder
+	// cur is the line number which the compiler will assign to the current line
+	cur := 0
+	next := 0
+	for i, line := range lines {
+		cur++
+		out := i + 1
+		for next < len(anchors) && anchors[next].out < out {
+			next++
+		}
+		if next < len(anchors) && anchors[next].out == out && anchors[next].orig != cur {
+			cur = anchors[next].orig
+			fmt.Fprintf(&b, "%s%s:%d:1\n", lineDirectivePrefix, filename, cur)
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Overlay is the file of the `-overlay` build flag, which replaces the original
+// files by the rewritten ones when building, see `go help build`.
+type Overlay struct {
+	// Replace maps the absolute paths of the original files to the rewritten
+	// files, the paths of the binding files do not exist in the source tree.
+	Replace map[string]string
+}
+
+// WriteOverlay writes the overlay file in JSON
+func WriteOverlay(path string, overlay *Overlay) error {
+	data, err := json.MarshalIndent(overlay, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// SetOverlay sets a directory and the rewrite results will write to it instead
+// of replacing the files, together with the binding files which do not exist in
+// the source tree. The files are recorded in the overlay, so that the packages can
+// be built with failpoints by `go build -overlay` and no file needs to be restored.
+// The rewritten files are written to the directory by their absolute paths, the
+// volume name of a path is a directory without the colon, e.g. `C` for `C:` on Windows.
+func (r *Rewriter) SetOverlay(dir string, overlay *Overlay) {
+	r.overlayDir = dir
+	r.overlay = overlay
+}
+
+// overlayTarget returns the path of the rewritten file of the absolute path in
+// the overlay directory, the volume name can not be joined as is, e.g. `out\C:\src`
+func overlayTarget(dir, absPath string) string {
+	volume := filepath.VolumeName(absPath)
+	rest := absPath[len(volume):]
+	volume = strings.Trim(strings.NewReplacer(":", "", `\`, "_", "/", "_").Replace(volume), "_")
+	return filepath.Join(dir, volume, rest)
+}
+
+// writeOverlay writes the rewritten file and its binding file to the overlay directory
+func (r *Rewriter) writeOverlay(path, pkgName string, content []byte) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	target := overlayTarget(r.overlayDir, absPath)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// The binding file is generated once for a package
+	bindingPath := failpointBindingPath(absPath)
+	found, err := isBindingFileExists(absPath)
+	if err != nil {
+		return err
+	}
+	r.locked(func() {
+		if r.overlay.Replace == nil {
+			r.overlay.Replace = map[string]string{}
+		}
+		if _, written := r.overlay.Replace[bindingPath]; !found && !written {
+			if err = writeBindingFile(target, pkgName); err == nil {
+				r.overlay.Replace[bindingPath] = failpointBindingPath(target)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(target, content, 0644); err != nil {
+		return err
+	}
+	r.locked(func() {
+		r.overlay.Replace[absPath] = target
+	})
+	return nil
+}
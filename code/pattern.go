@@ -0,0 +1,126 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SetInclude sets the glob patterns of the files rewritten by Rewrite, a file is
+// rewritten only if it matches any of the patterns. All the files are included if
+// it is not set. The patterns are matched against the slash-separated paths relative
+// to the rewrite path: a pattern without a slash matches any element of the path,
+// e.g. `*_gen.go` or `mocks`, otherwise it matches the path or any of its parent
+// directories, e.g. `pkg/*/internal`.
+func (r *Rewriter) SetInclude(patterns []string) {
+	r.include = patterns
+}
+
+// SetExclude sets the glob patterns of the files and directories which are not
+// rewritten by Rewrite, the patterns are matched like the ones of SetInclude.
+func (r *Rewriter) SetExclude(patterns []string) {
+	r.exclude = patterns
+}
+
+// SetRecursive sets whether Rewrite rewrites the files in the subdirectories of
+// the rewrite path, it is true by default. It is false for the directory of a
+// single package.
+func (r *Rewriter) SetRecursive(b bool) {
+	r.flat = !b
+}
+
+// checkPatterns returns an error if any of the include and exclude patterns is malformed
+func (r *Rewriter) checkPatterns() error {
+	for _, pattern := range append(append([]string(nil), r.include...), r.exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// relPath returns the slash-separated path relative to the rewrite path, which
+// the include and exclude patterns are matched against
+func (r *Rewriter) relPath(file string) string {
+	rel, err := filepath.Rel(r.rewriteDir, file)
+	if err != nil || rel == "." {
+		return filepath.Base(file)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// matchPatterns returns whether the slash-separated relative path matches any of the patterns
+func matchPatterns(patterns []string, rel string) bool {
+	elems := strings.Split(rel, "/")
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "./"), "/")
+		for i, elem := range elems {
+			name := elem
+			if strings.Contains(pattern, "/") {
+				name = strings.Join(elems[:i+1], "/")
+			}
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsPackagePattern returns whether the argument is a Go package pattern instead
+// of a path, i.e. it contains `...`, or it is an import path whose first element
+// looks like a domain and which does not exist as a relative path, e.g.
+// `github.com/pingcap/failpoint/code`. The other arguments are paths, so that a
+// mistyped path is reported as a missing path instead of being passed to `go list`.
+func IsPackagePattern(arg string) bool {
+	if strings.Contains(arg, "...") {
+		return true
+	}
+	if filepath.IsAbs(arg) || arg == "." || arg == ".." ||
+		strings.HasPrefix(arg, "./") || strings.HasPrefix(arg, "../") {
+		return false
+	}
+	if first, _, _ := strings.Cut(arg, "/"); !strings.Contains(first, ".") {
+		return false
+	}
+	_, err := os.Stat(arg)
+	return os.IsNotExist(err)
+}
+
+// PackageDirs returns the directories of the packages matched by the Go package
+// patterns in the directory, the patterns are resolved by `go list`.
+func PackageDirs(dir string, patterns ...string) ([]string, error) {
+	cmd := exec.Command("go", append([]string{"list", "-find", "-f", "{{.Dir}}", "--"}, patterns...)...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list %s: %v: %s", strings.Join(patterns, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	var dirs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			dirs = append(dirs, line)
+		}
+	}
+	return dirs, nil
+}
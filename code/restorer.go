@@ -28,8 +28,49 @@ import (
 const (
 	failpointStashFileSuffix = "__failpoint_stash__"
 	failpointBindingFileName = "binding__failpoint_binding__.go"
+	// failpointRejectFileSuffix is the suffix of the hunks which can not be merged back
+	failpointRejectFileSuffix = ".rej"
 )
 
+// RestoreState is the state of a restored file
+type RestoreState int
+
+const (
+	// RestoreClean means the file is restored without modifications
+	RestoreClean RestoreState = iota
+	// RestoreMerged means the modifications of the rewritten file are merged back
+	RestoreMerged
+	// RestoreConflicted means some of the modifications can not be merged back
+	RestoreConflicted
+)
+
+func (s RestoreState) String() string {
+	switch s {
+	case RestoreClean:
+		return "restored"
+	case RestoreMerged:
+		return "merged"
+	default:
+		return "conflicted"
+	}
+}
+
+// RestoreResult is the result of restoring a file
+type RestoreResult struct {
+	Path  string
+	State RestoreState
+	// Rejects is the file of the hunks which can not be merged back, it is
+	// empty unless the file is conflicted
+	Rejects string
+}
+
+// restoreMerge is the content of a file merged before it is restored
+type restoreMerge struct {
+	result  RestoreResult
+	content string
+	rejects string
+}
+
 // Restorer represents a manager to restore currentFile tree which has been modified by
 // `failpoint-ctl enable`, e.g:
 /*
@@ -51,7 +92,9 @@ const (
 //     └── foobar.go <- foobar.go__failpoint_stash__
 */
 type Restorer struct {
-	path string
+	path    string
+	force   bool
+	results []RestoreResult
 }
 
 // NewRestorer returns a non-nil restorer which is used to clean the workspace
@@ -60,11 +103,39 @@ func NewRestorer(path string) *Restorer {
 	return &Restorer{path: path}
 }
 
+// SetForce sets whether the conflicted files are restored with the modifications
+// which can be merged back. By default, no file is restored if any file conflicts.
+// The rejected hunks are written to the `.rej` files in both cases.
+func (r *Restorer) SetForce(b bool) {
+	r.force = b
+}
+
+// Results returns the results of the files restored by the last Restore, the
+// files are not restored if Restore returns an error for the conflicts.
+func (r *Restorer) Results() []RestoreResult {
+	return r.results
+}
+
 // Restore restores the currentFile tree which will delete all files generated
 // by `failpoint-ctl enable` and replace it by fail point stashed currentFile
-func (r Restorer) Restore() error {
+//
+// The files which are stashed but not completely rewritten by an interrupted
+// `failpoint-ctl enable` are rolled back by the journal before restoring. The
+// modifications of the rewritten files are merged back, and no file is restored
+// if any of them conflicts unless SetForce is set, see Results.
+func (r *Restorer) Restore() error {
+	roots, err := journalRoots(r.path)
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		if err := rollbackJournal(root); err != nil {
+			return err
+		}
+	}
+
 	var stashFiles []string
-	err := filepath.Walk(r.path, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(r.path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -72,7 +143,8 @@ func (r Restorer) Restore() error {
 			return nil
 		}
 		if strings.HasSuffix(path, failpointStashFileSuffix) ||
-			strings.HasSuffix(path, failpointBindingFileName) {
+			strings.HasSuffix(path, failpointBindingFileName) ||
+			isLineMapFile(path) {
 			stashFiles = append(stashFiles, path)
 		}
 		return nil
@@ -80,53 +152,197 @@ func (r Restorer) Restore() error {
 	if err != nil {
 		return err
 	}
+	// The packages loaded to restore the files rewritten in the type-aware mode
+	typedCache := map[string]map[string]typedFile{}
+	// The modifications of all the files are merged before any file is restored,
+	// so that the tree is not restored partially if some of them conflict
+	var merges []restoreMerge
+	var conflicts []string
+	r.results = nil
 	for _, filePath := range stashFiles {
-		if strings.HasSuffix(filePath, failpointBindingFileName) {
-			if err := os.Remove(filePath); err != nil {
-				return err
-			}
+		if !strings.HasSuffix(filePath, failpointStashFileSuffix) {
 			continue
 		}
-		originFileName := filePath[:len(filePath)-len(failpointStashFileSuffix)]
-		rewritedContent, err := ioutil.ReadFile(originFileName)
+		merge, err := r.merge(filePath, typedCache)
 		if err != nil {
 			return err
 		}
-		originContent, err := ioutil.ReadFile(filePath)
-		if err != nil {
-			return err
+		merges = append(merges, merge)
+		r.results = append(r.results, merge.result)
+		if merge.result.State == RestoreConflicted {
+			conflicts = append(conflicts, merge.result.Rejects)
 		}
-		// Rewrite original file
-		rewriter := NewRewriter(filePath)
-		buffer := &bytes.Buffer{}
-		rewriter.SetOutput(buffer)
-		if err := rewriter.RewriteFile(filePath); err != nil {
+	}
+	for _, merge := range merges {
+		if merge.result.Rejects == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(merge.result.Rejects, []byte(merge.rejects), 0644); err != nil {
 			return err
 		}
+	}
+	if len(conflicts) > 0 && !r.force {
+		return fmt.Errorf("cannot merge modifications back automatically, the rejected hunks are written to:\n  %s", strings.Join(conflicts, "\n  "))
+	}
 
-		// Merge modifications after `failpoint-ctl enable`
-		patcher := diffmatchpatch.New()
-		diffs := patcher.DiffMain(buffer.String(), string(rewritedContent), true)
-		patches := patcher.PatchMake(diffs)
-		pathedContent, results := patcher.PatchApply(patches, string(originContent))
-		for i, result := range results {
-			if !result {
-				return fmt.Errorf("cannot merge modifications back automatically %s", patches[i].String())
-			}
+	for _, merge := range merges {
+		// The stash file is kept until the file is restored, it must match the journal
+		if err := ioutil.WriteFile(merge.result.Path, []byte(merge.content), 0644); err != nil {
+			return err
 		}
-		if err := ioutil.WriteFile(filePath, []byte(pathedContent), 0644); err != nil {
+		if err := os.Remove(merge.result.Path + failpointStashFileSuffix); err != nil {
 			return err
 		}
-		if err := os.Remove(originFileName); err != nil {
+	}
+	// The line maps are removed after the files are restored, they record
+	// whether the files have been rewritten in the type-aware mode. The line
+	// maps may be in the sidecar directory of a parent directory.
+	for _, merge := range merges {
+		if err := removeLineMap(merge.result.Path); err != nil {
 			return err
 		}
-		if err := os.Rename(filePath, originFileName); err != nil {
+	}
+	for _, filePath := range stashFiles {
+		switch {
+		case strings.HasSuffix(filePath, failpointStashFileSuffix):
+			continue
+		case isLineMapFile(filePath):
+			if err := removeLineMapFile(filePath); err != nil {
+				return err
+			}
+		default:
+			if err := os.Remove(filePath); err != nil {
+				return err
+			}
+		}
+	}
+	// The journals are removed at last, so an interrupted restoring can be resumed
+	for _, root := range roots {
+		if err := revealToGit(root); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(root, failpointJournalFileName)); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
 	return nil
 }
 
+// merge merges the modifications of the rewritten file back to the stashed file
+func (r *Restorer) merge(filePath string, typedCache map[string]map[string]typedFile) (restoreMerge, error) {
+	originFileName := filePath[:len(filePath)-len(failpointStashFileSuffix)]
+	merge := restoreMerge{result: RestoreResult{Path: originFileName}}
+	rewritedContent, err := ioutil.ReadFile(originFileName)
+	if err != nil {
+		return merge, err
+	}
+	originContent, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return merge, err
+	}
+	// Rewrite original file
+	rewriter := NewRewriter(filePath)
+	buffer := &bytes.Buffer{}
+	rewriter.SetOutput(buffer)
+	// Generate the same line directives as `failpoint-ctl enable` did,
+	// otherwise they will be merged back as modifications
+	lineFile := filepath.Base(originFileName)
+	if bytes.Contains(rewritedContent, []byte("\n"+lineDirectivePrefix+lineFile+":")) {
+		rewriter.SetLineDirectives(true)
+		rewriter.lineFile = lineFile
+	}
+	typeCheck, err := isTypeChecked(originFileName)
+	if err != nil {
+		return merge, err
+	}
+	if typeCheck {
+		err = rewriter.rewriteStashed(originFileName, originContent, typedCache)
+	} else {
+		err = rewriter.RewriteFile(filePath)
+	}
+	if err != nil {
+		return merge, err
+	}
+
+	// Merge modifications after `failpoint-ctl enable`
+	if buffer.String() == string(rewritedContent) {
+		merge.content = string(originContent)
+		return merge, nil
+	}
+	patcher := diffmatchpatch.New()
+	diffs := patcher.DiffMain(buffer.String(), string(rewritedContent), true)
+	patches := patcher.PatchMake(diffs)
+	pathedContent, results := patcher.PatchApply(patches, string(originContent))
+	merge.content = pathedContent
+	merge.result.State = RestoreMerged
+	var rejects strings.Builder
+	for i, result := range results {
+		if !result {
+			rejects.WriteString(rejectHunk(patches[i], buffer.String(), string(rewritedContent)))
+		}
+	}
+	if rejects.Len() > 0 {
+		merge.result.State = RestoreConflicted
+		merge.result.Rejects = originFileName + failpointRejectFileSuffix
+		merge.rejects = fmt.Sprintf("--- %s\n+++ %s\n%s", originFileName, originFileName, rejects.String())
+	}
+	return merge, nil
+}
+
+// rejectHunk formats the patch which can not be merged as a unified hunk of the
+// lines modified in the rewritten file
+func rejectHunk(patch diffmatchpatch.Patch, generated, modified string) string {
+	line1, lines1 := patchLines(generated, patch.Start1, patch.Length1)
+	line2, lines2 := patchLines(modified, patch.Start2, patch.Length2)
+	var b strings.Builder
+	fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", line1, len(lines1), line2, len(lines2))
+	for _, line := range lines1 {
+		b.WriteString("-" + line + "\n")
+	}
+	for _, line := range lines2 {
+		b.WriteString("+" + line + "\n")
+	}
+	return b.String()
+}
+
+// patchLines returns the first line number and the lines covered by the range
+// of runes in the text
+func patchLines(text string, start, length int) (int, []string) {
+	runes := []rune(text)
+	if start < 0 {
+		start = 0
+	} else if start > len(runes) {
+		start = len(runes)
+	}
+	end := start + length
+	if end > len(runes) {
+		end = len(runes)
+	}
+	begin := start
+	for begin > 0 && runes[begin-1] != '\n' {
+		begin--
+	}
+	for end < len(runes) && (end == begin || runes[end-1] != '\n') {
+		end++
+	}
+	line := strings.Count(string(runes[:begin]), "\n") + 1
+	covered := strings.TrimSuffix(string(runes[begin:end]), "\n")
+	return line, strings.Split(covered, "\n")
+}
+
+// isTypeChecked returns whether the file has been rewritten in the type-aware mode
+func isTypeChecked(path string) (bool, error) {
+	lineMap, err := findLineMap(path)
+	if err != nil || lineMap == "" {
+		return false, err
+	}
+	m, err := readLineMap(lineMap)
+	if err != nil {
+		return false, err
+	}
+	return m.TypeCheck, nil
+}
+
 func failpointBindingPath(path string) string {
 	return filepath.Join(filepath.Dir(path), failpointBindingFileName)
 }
@@ -141,8 +357,12 @@ func isBindingFileExists(path string) (bool, error) {
 }
 
 func writeBindingFile(path, pak string) error {
-	bindingFile := failpointBindingPath(path)
-	bindingContent := fmt.Sprintf(`
+	return ioutil.WriteFile(failpointBindingPath(path), []byte(bindingContent(pak)), 0644)
+}
+
+// bindingContent returns the binding code of the package, which defines the `_curpkg_` function
+func bindingContent(pak string) string {
+	return fmt.Sprintf(`
 package %s
 
 import "reflect"
@@ -157,5 +377,4 @@ func %s(name string) string {
 	return  __failpointBindingCache.pkgpath + "/" + name
 }
 `, pak, ExtendPkgName)
-	return ioutil.WriteFile(bindingFile, []byte(bindingContent), 0644)
 }
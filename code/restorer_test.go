@@ -306,3 +306,185 @@ func unittest() {
 	require.Error(t, err)
 	require.Regexp(t, `cannot merge modifications back automatically.*`, err.Error())
 }
+
+func TestRestoreLineDirectives(t *testing.T) {
+	original := `package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", func(
+		val failpoint.Value,
+	) {
+		fmt.Println("unit-test", val)
+	})
+}
+`
+	expected := `package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", func(
+		val failpoint.Value,
+	) {
+		fmt.Println("unit-test", val)
+		fmt.Println("extra add line")
+	})
+}
+`
+	tempDir := t.TempDir()
+	fileName := filepath.Join(tempDir, "line-directives.go")
+	require.NoError(t, os.WriteFile(fileName, []byte(original), 0644))
+
+	rewriter := code.NewRewriter(tempDir)
+	rewriter.SetLineDirectives(true)
+	require.NoError(t, rewriter.Rewrite())
+
+	content, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "//line line-directives.go:")
+	modified := strings.Replace(string(content), "\t\tfmt.Println(\"unit-test\", val)\n",
+		"\t\tfmt.Println(\"unit-test\", val)\n\t\tfmt.Println(\"extra add line\")\n", 1)
+	require.NoError(t, os.WriteFile(fileName, []byte(modified), 0644))
+
+	restorer := code.NewRestorer(tempDir)
+	require.NoError(t, restorer.Restore())
+	content, err = os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(content))
+}
+
+func TestRestoreJournal(t *testing.T) {
+	original := `
+package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", func() {
+		fmt.Println("unit-test")
+	})
+}
+`
+	tempDir := t.TempDir()
+	files := []string{filepath.Join(tempDir, "a.go"), filepath.Join(tempDir, "b.go")}
+	for _, file := range files {
+		require.NoError(t, os.WriteFile(file, []byte(original), 0644))
+	}
+	require.NoError(t, code.NewRewriter(tempDir).Rewrite())
+	journal := filepath.Join(tempDir, "__failpoint_journal__")
+	content, err := os.ReadFile(journal)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 5)
+	require.Contains(t, lines[0], `"op":"binding","path":"binding__failpoint_binding__.go"`)
+	require.Contains(t, lines[1], `"op":"stash","path":"a.go","hash":`)
+	require.Contains(t, lines[4], `"op":"rewritten","path":"b.go"`)
+
+	// Simulate the interruption after b.go is stashed, the partial b.go is
+	// rolled back and a.go is restored with its modification
+	require.NoError(t, os.WriteFile(journal, []byte(strings.Join(lines[:4], "\n")+"\n{\"op\":"), 0644))
+	require.NoError(t, os.WriteFile(files[1], []byte("package rewriter_"), 0644))
+	rewritten, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	modified := strings.Replace(string(rewritten), `"unit-test"`, `"modified"`, 1)
+	require.NoError(t, os.WriteFile(files[0], []byte(modified), 0644))
+
+	require.NoError(t, code.NewRestorer(tempDir).Restore())
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	content, err = os.ReadFile(files[0])
+	require.NoError(t, err)
+	require.Equal(t, strings.Replace(original, `"unit-test"`, `"modified"`, 1), string(content))
+	content, err = os.ReadFile(files[1])
+	require.NoError(t, err)
+	require.Equal(t, original, string(content))
+
+	// The stash files must match the journal
+	require.NoError(t, code.NewRewriter(tempDir).Rewrite())
+	require.NoError(t, os.WriteFile(files[0]+"__failpoint_stash__", []byte("package rewriter_test\n"), 0644))
+	err = code.NewRestorer(tempDir).Restore()
+	require.Error(t, err)
+	require.Regexp(t, `stash file .*a\.go__failpoint_stash__ does not match the journal`, err.Error())
+}
+
+func TestRestoreConflicts(t *testing.T) {
+	original := `
+package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", func(val failpoint.Value) {
+		fmt.Println("unit-test", val)
+	})
+}
+`
+	tempDir := t.TempDir()
+	names := []string{"clean.go", "merged.go", "conflicted.go"}
+	for _, name := range names {
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, name), []byte(original), 0644))
+	}
+	require.NoError(t, code.NewRewriter(tempDir).Rewrite())
+
+	modify := func(name, old, new string) {
+		fileName := filepath.Join(tempDir, name)
+		content, err := os.ReadFile(fileName)
+		require.NoError(t, err)
+		require.Contains(t, string(content), old)
+		require.NoError(t, os.WriteFile(fileName, []byte(strings.Replace(string(content), old, new, 1)), 0644))
+	}
+	modify("merged.go", `"unit-test"`, `"modified"`)
+	modify("conflicted.go", `_err_ == nil {`, `_err_ != nil {`)
+
+	// No file is restored if any file conflicts
+	restorer := code.NewRestorer(tempDir)
+	err := restorer.Restore()
+	require.Error(t, err)
+	rejects := filepath.Join(tempDir, "conflicted.go.rej")
+	require.Equal(t, "cannot merge modifications back automatically, the rejected hunks are written to:\n  "+rejects, err.Error())
+	for _, name := range names {
+		_, err := os.Stat(filepath.Join(tempDir, name+"__failpoint_stash__"))
+		require.NoError(t, err)
+	}
+	content, err := os.ReadFile(rejects)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "-\tif val, _err_ := failpoint.Eval(_curpkg_(\"failpoint-name\")); _err_ == nil {\n")
+	require.Contains(t, string(content), "+\tif val, _err_ := failpoint.Eval(_curpkg_(\"failpoint-name\")); _err_ != nil {\n")
+
+	// The conflicted files are restored with the rejected hunks in force mode
+	restorer.SetForce(true)
+	require.NoError(t, restorer.Restore())
+	require.Equal(t, []code.RestoreResult{
+		{Path: filepath.Join(tempDir, "clean.go"), State: code.RestoreClean},
+		{Path: filepath.Join(tempDir, "conflicted.go"), State: code.RestoreConflicted, Rejects: rejects},
+		{Path: filepath.Join(tempDir, "merged.go"), State: code.RestoreMerged},
+	}, restorer.Results())
+	content, err = os.ReadFile(filepath.Join(tempDir, "merged.go"))
+	require.NoError(t, err)
+	require.Equal(t, strings.Replace(original, `"unit-test"`, `"modified"`, 1), string(content))
+	content, err = os.ReadFile(filepath.Join(tempDir, "conflicted.go"))
+	require.NoError(t, err)
+	require.Equal(t, original, string(content))
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+}
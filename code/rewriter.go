@@ -15,25 +15,44 @@
 package code
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"go/ast"
-	"go/format"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/failpoint"
 )
 
 const (
-	packagePath     = "github.com/pingcap/failpoint"
-	packageName     = "failpoint"
-	evalFunction    = "Eval"
-	callFunction    = "Call"
-	evalCtxFunction = "EvalContext"
-	ExtendPkgName   = "_curpkg_"
+	packagePath       = "github.com/pingcap/failpoint"
+	packageName       = "failpoint"
+	evalFunction      = "Eval"
+	callFunction      = "Call"
+	evalCtxFunction   = "EvalContext"
+	evalAsFunction    = "EvalAs"
+	evalCtxAsFunction = "EvalContextAs"
+	overrideFunction  = "EvalOverride"
+	selectFunction    = "EvalSelect"
+	selectCaseFunc    = "SelectCase"
+	selectOtherFunc   = "SelectOther"
+	selectAfterFunc   = "SelectAfter"
+	ExtendPkgName     = "_curpkg_"
+	// The markers rewritten in the expressions instead of the statements
+	overrideMarker = "Override"
+	caseMarker     = "Case"
+	afterMarker    = "After"
 	// It is an indicator to indicate the label is converted from `failpoint.Label("...")`
 	// We use an illegal suffix to avoid conflict with the user's code
 	// So `failpoint.Label("label1")` will be converted to `label1-tmp-marker:` in expression
@@ -52,8 +71,69 @@ type Rewriter struct {
 	failpointName   string
 	allowNotChecked bool
 	rewritten       bool
+	lineDirectives  bool
+	strict          bool
+	typeCheck       bool
+	git             bool
+	// info is the type information of the file being rewritten, it is nil
+	// if the file is rewritten syntactically.
+	info *types.Info
+	// lineFile is the file name used in the line directives, the rewritten file
+	// name is used if it is empty.
+	lineFile string
+	// lineMap is the line map of the last rewritten file
+	lineMap *LineMap
+	// warnings are the unsupported statements and expressions of the last
+	// rewritten file, which are logged again if the file is rewritten by the cache
+	warnings []string
+	// logger receives the warnings and the skipped files, see SetLogger
+	logger failpoint.Logger
+	// scopes are the enclosing functions of the statements being rewritten
+	scopes []*funcScope
+	// nextLabel is the label of the next statement to rewrite, which is
+	// either a labeled statement or follows `failpoint.Label`
+	nextLabel string
 
 	output io.Writer
+	// outputFunc returns the writer of each rewritten file, see SetOutputFunc
+	outputFunc func(path string) (io.Writer, error)
+	// written are the files rewritten in place by Rewrite
+	written []string
+	// overlayDir and overlay are the directory and the overlay which the
+	// rewritten files are written to, see SetOverlay
+	overlayDir string
+	overlay    *Overlay
+	// cache is the cache of the rewriting results, see SetCache
+	cache *Cache
+
+	// workers is the number of the goroutines rewriting the directories
+	workers int
+	// skipDirs are the names of the directories not walked by Rewrite
+	skipDirs []string
+	// include and exclude are the glob patterns of the rewritten files, and
+	// flat is whether the subdirectories are not rewritten, see SetInclude
+	include []string
+	exclude []string
+	flat    bool
+	// stats is the statistics of the last Rewrite
+	stats RewriteStats
+	// mu guards the states shared by the forked rewriters of Rewrite, and
+	// parent is the rewriter which a forked one reports the written files to
+	mu     *sync.Mutex
+	parent *Rewriter
+}
+
+// DefaultSkipDirs are the names of the directories not walked by Rewrite by default
+var DefaultSkipDirs = []string{"vendor", "testdata", ".git"}
+
+// RewriteStats is the statistics of a Rewrite call
+type RewriteStats struct {
+	// Scanned is the number of the Go files walked
+	Scanned int
+	// Rewritten is the number of the rewritten files
+	Rewritten int
+	// Elapsed is the duration of the rewriting
+	Elapsed time.Duration
 }
 
 // NewRewriter returns a non-nil rewriter which is used to rewrite the specified path
@@ -68,11 +148,79 @@ func (r *Rewriter) SetOutput(out io.Writer) {
 	r.output = out
 }
 
+// SetGit sets whether the rewriting is hidden from git. The generated files are
+// excluded by the `info/exclude` of the git repository, and the rewritten files
+// tracked by git are marked as skip-worktree, both until they are restored, so that
+// they are not shown by `git status` or staged by `git add`.
+func (r *Rewriter) SetGit(b bool) {
+	r.git = b
+}
+
+// SetOutputFunc sets a function which returns the writer of each rewritten file, the
+// rewrite results will write to the writers instead of replacing the files, and no
+// stash file, binding file or line map is generated. Unlike SetOutput, the line
+// directives refer to the files in place, so the results are the same as the files
+// rewritten by Rewrite without it.
+func (r *Rewriter) SetOutputFunc(fn func(path string) (io.Writer, error)) {
+	r.outputFunc = fn
+}
+
+// SetWorkers sets the number of the directories rewritten concurrently by Rewrite,
+// it is runtime.GOMAXPROCS(0) if n is not positive.
+func (r *Rewriter) SetWorkers(n int) {
+	r.workers = n
+}
+
+// SetSkipDirs sets the names of the directories not walked by Rewrite, which are
+// DefaultSkipDirs if it is not set. The rewrite path itself is never skipped.
+func (r *Rewriter) SetSkipDirs(names []string) {
+	r.skipDirs = names
+}
+
+// Stats returns the statistics of the last Rewrite call
+func (r *Rewriter) Stats() RewriteStats {
+	return r.stats
+}
+
 // SetAllowNotChecked sets whether the rewriter allows the file which does not import failpoint package.
 func (r *Rewriter) SetAllowNotChecked(b bool) {
 	r.allowNotChecked = b
 }
 
+// SetLineDirectives sets whether the rewriter emits `//line` directives to map
+// the lines shifted by the rewriting back to the original file.
+func (r *Rewriter) SetLineDirectives(b bool) {
+	r.lineDirectives = b
+}
+
+// SetStrict sets whether the rewriter reports the statements and expressions it
+// does not support, and the marker functions referenced without being called,
+// as errors instead of warnings.
+func (r *Rewriter) SetStrict(b bool) {
+	r.strict = b
+}
+
+// SetTypeCheck sets whether the rewriter loads the packages with their type information
+// to resolve the marker functions, so that the markers called through a dot-import are
+// rewritten, the identifiers shadowing the failpoint package are left untouched, and the
+// type errors of the rewritten code are reported by Rewrite instead of the compiler.
+func (r *Rewriter) SetTypeCheck(b bool) {
+	r.typeCheck = b
+}
+
+// SetLogger sets the logger which receives the statements and expressions not
+// supported by the non-strict rewriter, and the files skipped because they have
+// been rewritten already. The messages are dropped if the logger is nil.
+func (r *Rewriter) SetLogger(l failpoint.Logger) {
+	r.logger = l
+}
+
+// GetLineMap returns the line map of the file rewritten by the last RewriteFile
+// call, it is nil if the file has not been rewritten.
+func (r *Rewriter) GetLineMap() *LineMap {
+	return r.lineMap
+}
+
 // GetRewritten returns whether the rewriter has rewritten the file in a RewriteFile call.
 func (r *Rewriter) GetRewritten() bool {
 	return r.rewritten
@@ -88,8 +236,67 @@ func (r *Rewriter) pos(pos token.Pos) string {
 	return fmt.Sprintf("%s:%d", p.Filename, p.Line)
 }
 
+// funcScope is the function which the rewritten `return`, `break` and `continue`
+// statements belong to.
+type funcScope struct {
+	results *ast.FieldList
+	// closure is the statement which runs the function literal, e.g. `go` or `defer`
+	closure string
+	// targets are the enclosing statements which can be the target of `break` and `continue`
+	targets []branchTarget
+}
+
+type branchTarget struct {
+	label string
+	loop  bool
+}
+
+// scope returns the innermost enclosing function, it is nil if the statements
+// are not in a function.
+func (r *Rewriter) scope() *funcScope {
+	if len(r.scopes) == 0 {
+		return nil
+	}
+	return r.scopes[len(r.scopes)-1]
+}
+
+// rewriteFuncBody rewrites the body of a function declaration or literal, the
+// closure is the statement which runs the function literal, if any.
+func (r *Rewriter) rewriteFuncBody(typ *ast.FuncType, body *ast.BlockStmt, closure string) error {
+	r.scopes = append(r.scopes, &funcScope{results: typ.Results, closure: closure})
+	defer func() {
+		r.scopes = r.scopes[:len(r.scopes)-1]
+	}()
+	return r.rewriteStmts(body.List)
+}
+
+// rewriteBranchTarget rewrites the body of a loop, switch or select statement
+func (r *Rewriter) rewriteBranchTarget(label string, loop bool, stmts []ast.Stmt) error {
+	scope := r.scope()
+	if scope == nil {
+		return r.rewriteStmts(stmts)
+	}
+	scope.targets = append(scope.targets, branchTarget{label: label, loop: loop})
+	defer func() {
+		scope.targets = scope.targets[:len(scope.targets)-1]
+	}()
+	return r.rewriteStmts(stmts)
+}
+
 func (r *Rewriter) rewriteFuncLit(fn *ast.FuncLit) error {
-	return r.rewriteStmts(fn.Body.List)
+	return r.rewriteFuncBody(fn.Type, fn.Body, "")
+}
+
+// rewriteClosureCall rewrites the call of a `go` or `defer` statement
+func (r *Rewriter) rewriteClosureCall(call *ast.CallExpr, closure string) error {
+	fn, ok := call.Fun.(*ast.FuncLit)
+	if !ok {
+		return r.rewriteExpr(call)
+	}
+	if err := r.rewriteFuncBody(fn.Type, fn.Body, closure); err != nil {
+		return err
+	}
+	return r.rewriteExprs(call.Args)
 }
 
 func (r *Rewriter) rewriteAssign(v *ast.AssignStmt) error {
@@ -209,21 +416,23 @@ func (r *Rewriter) rewriteExpr(expr ast.Expr) error {
 
 	case *ast.CallExpr:
 		// return func() int {...}()
-		if fn, ok := ex.Fun.(*ast.FuncLit); ok {
-			err := r.rewriteFuncLit(fn)
-			if err != nil {
-				return err
-			}
+		// return (&T{fn: func() {...}}).Method()
+		if err := r.rewriteExpr(ex.Fun); err != nil {
+			return err
 		}
 
 		// return fn(func() int{...})
-		for _, arg := range ex.Args {
-			if fn, ok := arg.(*ast.FuncLit); ok {
-				err := r.rewriteFuncLit(fn)
-				if err != nil {
-					return err
-				}
-			}
+		// return fn(T{fn: func() int{...}})
+		if err := r.rewriteExprs(ex.Args); err != nil {
+			return err
+		}
+
+		// n := failpoint.Override("failpoint-name", computeN())
+		// return failpoint.Override("failpoint-name", n)
+		// fn(failpoint.Override("failpoint-name", n))
+		// failpoint.Override[int64]("failpoint-name", 1)
+		if name, ok := r.markerName(uninstantiated(ex.Fun)); ok && name == overrideMarker {
+			return r.rewriteOverride(ex)
 		}
 
 	case *ast.StarExpr:
@@ -257,9 +466,28 @@ func (r *Rewriter) rewriteExpr(expr ast.Expr) error {
 		// Key: (func() {...}())
 		return r.rewriteExpr(ex.Value)
 
+	case *ast.IndexListExpr:
+		// generic[int, string](func() {...})
+		if err := r.rewriteExpr(ex.X); err != nil {
+			return err
+		}
+		return r.rewriteExprs(ex.Indices)
+
 	default:
-		fmt.Printf("unspport expression: %T\n", expr)
+		return r.unsupported("expression", expr)
+	}
+	return nil
+}
+
+// unsupported reports a node which the rewriter can not traverse, the markers
+// inside it will be reported by verifyMarkers.
+func (r *Rewriter) unsupported(kind string, node ast.Node) error {
+	if r.strict {
+		return fmt.Errorf("unsupported %s: %T in %s", kind, node, r.pos(node.Pos()))
 	}
+	warning := fmt.Sprintf("unsupported %s: %T in %s", kind, node, r.pos(node.Pos()))
+	r.warnings = append(r.warnings, warning)
+	r.log(warning, "file", r.currentPath)
 	return nil
 }
 
@@ -274,7 +502,12 @@ func (r *Rewriter) rewriteExprs(exprs []ast.Expr) error {
 }
 
 func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
+	defer func() {
+		r.nextLabel = ""
+	}()
 	for i, block := range stmts {
+		label := r.nextLabel
+		r.nextLabel = ""
 		switch v := block.(type) {
 		case *ast.DeclStmt:
 			// var fn1, fn2, fn3, ... = func(){...}, func(){...}, func(){...}, ...
@@ -283,22 +516,10 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 			//         ...
 			//     })
 			// }
-			specs := v.Decl.(*ast.GenDecl).Specs
-			for _, spec := range specs {
-				vs, ok := spec.(*ast.ValueSpec)
-				if !ok {
-					continue
-				}
-				for _, v := range vs.Values {
-					fn, ok := v.(*ast.FuncLit)
-					if !ok {
-						continue
-					}
-					err := r.rewriteStmts(fn.Body.List)
-					if err != nil {
-						return err
-					}
-				}
+			// var t = T{fn: func() {...}}
+			err := r.rewriteGenDecl(v.Decl.(*ast.GenDecl))
+			if err != nil {
+				return err
 			}
 
 		case *ast.ExprStmt:
@@ -314,7 +535,21 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 			if !ok {
 				break
 			}
+			name, isMarker := r.markerName(call.Fun)
+			if isMarker && exprMarkers[name] {
+				if err := r.rewriteExpr(call); err != nil {
+					return err
+				}
+				break
+			}
 			for _, arg := range call.Args {
+				// The closure of the marker is inlined into the enclosing function
+				if fn, ok := arg.(*ast.FuncLit); ok && isMarker && (name == "Inject" || name == "InjectContext") {
+					if err := r.rewriteStmts(fn.Body.List); err != nil {
+						return err
+					}
+					continue
+				}
 				err := r.rewriteExpr(arg)
 				if err != nil {
 					return err
@@ -327,15 +562,11 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 				if err != nil {
 					return err
 				}
-			case *ast.SelectorExpr:
-				packageName, ok := expr.X.(*ast.Ident)
-				if !ok || packageName.Name != r.failpointName {
-					break
-				}
-				exprRewriter, found := exprRewriters[expr.Sel.Name]
-				if !found {
+			case *ast.SelectorExpr, *ast.Ident:
+				if !isMarker {
 					break
 				}
+				exprRewriter := exprRewriters[name]
 				rewritten, stmt, err := exprRewriter(r, call)
 				if err != nil {
 					return err
@@ -343,6 +574,10 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 				if !rewritten {
 					continue
 				}
+				// failpoint.Label("label") labels the next statement
+				if labeled, ok := stmt.(*ast.LabeledStmt); ok {
+					r.nextLabel = strings.TrimSuffix(labeled.Label.Name, labelSuffix)
+				}
 
 				if ifStmt, ok := stmt.(*ast.IfStmt); ok {
 					err := r.rewriteIfStmt(ifStmt)
@@ -365,7 +600,7 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 		case *ast.GoStmt:
 			// go func() {...}()
 			// go func(fn) {...}(func(){...})
-			err := r.rewriteExpr(v.Call)
+			err := r.rewriteClosureCall(v.Call, "go")
 			if err != nil {
 				return err
 			}
@@ -373,7 +608,7 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 		case *ast.DeferStmt:
 			// defer func() {...}()
 			// defer func(fn) {...}(func(){...})
-			err := r.rewriteExpr(v.Call)
+			err := r.rewriteClosureCall(v.Call, "defer")
 			if err != nil {
 				return err
 			}
@@ -438,7 +673,7 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 			// case 1:
 			// 	func() {...}()
 			// }
-			err := r.rewriteStmts(v.Body.List)
+			err := r.rewriteBranchTarget(label, false, v.Body.List)
 			if err != nil {
 				return err
 			}
@@ -464,6 +699,13 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 						return err
 					}
 				}
+				// case func() chan int {...}() <- func() int {...}():
+				if send, ok := v.Comm.(*ast.SendStmt); ok {
+					err := r.rewriteExprs([]ast.Expr{send.Chan, send.Value})
+					if err != nil {
+						return err
+					}
+				}
 			}
 			err := r.rewriteStmts(v.Body)
 			if err != nil {
@@ -474,10 +716,22 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 			if len(v.Body.List) < 1 {
 				continue
 			}
-			err := r.rewriteStmts(v.Body.List)
+			err := r.rewriteBranchTarget(label, false, v.Body.List)
 			if err != nil {
 				return err
 			}
+			// select {
+			// case <-failpoint.Case("failpoint-name", ch):
+			// case <-failpoint.After("failpoint-name"):
+			// }
+			wrapped, err := r.rewriteSelect(v)
+			if err != nil {
+				return err
+			}
+			if wrapped != nil {
+				stmts[i] = wrapped
+				r.rewritten = true
+			}
 
 		case *ast.ForStmt:
 			// for i := func() int {...}(); i < func() int {...}(); i += func() int {...}() {...}
@@ -503,7 +757,7 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 					}
 				}
 			}
-			err := r.rewriteStmts(v.Body.List)
+			err := r.rewriteBranchTarget(label, true, v.Body.List)
 			if err != nil {
 				return err
 			}
@@ -513,7 +767,7 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 			if err := r.rewriteExpr(v.X); err != nil {
 				return err
 			}
-			err := r.rewriteStmts(v.Body.List)
+			err := r.rewriteBranchTarget(label, true, v.Body.List)
 			if err != nil {
 				return err
 			}
@@ -535,7 +789,7 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 					}
 				}
 			}
-			err := r.rewriteStmts(v.Body.List)
+			err := r.rewriteBranchTarget(label, false, v.Body.List)
 			if err != nil {
 				return err
 			}
@@ -550,12 +804,24 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 		case *ast.LabeledStmt:
 			// Label:
 			//     func () {...}()
-			stmts := []ast.Stmt{v.Stmt}
-			err := r.rewriteStmts(stmts)
+			labeled := []ast.Stmt{v.Stmt}
+			_, isSelect := v.Stmt.(*ast.SelectStmt)
+			r.nextLabel = v.Label.Name
+			err := r.rewriteStmts(labeled)
 			if err != nil {
 				return err
 			}
-			v.Stmt = stmts[0]
+			// The label of a wrapped select statement is moved into the block,
+			// so `break label` still refers to the select statement
+			if wrapped, ok := labeled[0].(*ast.BlockStmt); ok && isSelect {
+				last := len(wrapped.List) - 1
+				v.Stmt = wrapped.List[last]
+				wrapped.List[last] = v
+				wrapped.Lbrace = v.Pos()
+				stmts[i] = wrapped
+				break
+			}
+			v.Stmt = labeled[0]
 
 		case *ast.IncDecStmt:
 			// func() *FooType {...}().Field++
@@ -568,8 +834,12 @@ func (r *Rewriter) rewriteStmts(stmts []ast.Stmt) error {
 		case *ast.BranchStmt:
 			// ignore keyword token (BREAK, CONTINUE, GOTO, FALLTHROUGH)
 
+		case *ast.EmptyStmt:
+
 		default:
-			fmt.Printf("unsupported statement: %T in %s\n", v, r.pos(v.Pos()))
+			if err := r.unsupported("statement", v); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -589,28 +859,237 @@ func (r *Rewriter) rewriteFuncDecl(fn *ast.FuncDecl) error {
 	if fn.Body == nil {
 		return nil
 	}
-	return r.rewriteStmts(fn.Body.List)
+	return r.rewriteFuncBody(fn.Type, fn.Body, "")
+}
+
+// rewriteGenDecl rewrites the function literals in the values of the variable
+// declarations, including the ones nested in composite literals, e.g.
+// `var handler = func() {...}` or `var t = T{fn: func() {...}}`.
+func (r *Rewriter) rewriteGenDecl(decl *ast.GenDecl) error {
+	for _, spec := range decl.Specs {
+		vs, ok := spec.(*ast.ValueSpec)
+		if !ok {
+			continue
+		}
+		if err := r.rewriteExprs(vs.Values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyMarkers is the post-rewrite verification pass, it returns an error with
+// the positions of all the marker calls left in the file, which means the markers
+// are in positions that can not be rewritten and they would silently be no-ops.
+// In strict mode, the markers referenced without being called are reported too.
+func (r *Rewriter) verifyMarkers(file *ast.File) error {
+	called := map[ast.Expr]bool{}
+	var errs []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.CallExpr:
+			if name, ok := r.markerName(uninstantiated(v.Fun)); ok {
+				called[uninstantiated(v.Fun)] = true
+				errs = append(errs, fmt.Sprintf("failpoint.%s: marker can not be rewritten in %s", name, r.pos(v.Pos())))
+			}
+		case *ast.SelectorExpr, *ast.Ident:
+			name, ok := r.markerName(v.(ast.Expr))
+			if !ok {
+				break
+			}
+			if r.strict && !called[v.(ast.Expr)] {
+				errs = append(errs, fmt.Sprintf("failpoint.%s: marker must be called directly in %s", name, r.pos(v.Pos())))
+			}
+			// The selected identifier refers to the marker too
+			return false
+		}
+		return true
+	})
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "\n"))
+}
+
+// markerName returns the name of the marker function if the expression refers to
+// one, e.g. `failpoint.Inject`. The type information is used if it is available,
+// otherwise the expression must be selected from the failpoint import name.
+func (r *Rewriter) markerName(expr ast.Expr) (string, bool) {
+	var ident *ast.Ident
+	switch v := expr.(type) {
+	case *ast.Ident:
+		if r.info == nil {
+			return "", false
+		}
+		ident = v
+	case *ast.SelectorExpr:
+		if r.info == nil {
+			if pkg, ok := v.X.(*ast.Ident); !ok || pkg.Name != r.failpointName {
+				return "", false
+			}
+		}
+		ident = v.Sel
+	default:
+		return "", false
+	}
+	if r.info != nil {
+		fn, ok := r.info.Uses[ident].(*types.Func)
+		if !ok || fn.Pkg() == nil || fn.Pkg().Path() != packagePath {
+			return "", false
+		}
+	}
+	_, found := exprRewriters[ident.Name]
+	return ident.Name, found || exprMarkers[ident.Name]
+}
+
+// uninstantiated returns the generic function of the explicit instantiation,
+// e.g. `failpoint.Override` of `failpoint.Override[int]`
+func uninstantiated(expr ast.Expr) ast.Expr {
+	switch v := expr.(type) {
+	case *ast.IndexExpr:
+		return v.X
+	case *ast.IndexListExpr:
+		return v.X
+	}
+	return expr
+}
+
+// isValueType returns whether the expression is the type `failpoint.Value`
+func (r *Rewriter) isValueType(expr ast.Expr) bool {
+	if r.info != nil {
+		named, ok := r.info.TypeOf(expr).(*types.Named)
+		return ok && named.Obj().Pkg() != nil && named.Obj().Pkg().Path() == packagePath && named.Obj().Name() == "Value"
+	}
+	selector, ok := expr.(*ast.SelectorExpr)
+	return ok && selector.Sel.Name == "Value" && selector.X.(*ast.Ident).Name == r.failpointName
+}
+
+// failpointSelector returns the expression which refers to the function of the
+// failpoint package in the rewritten code, e.g. `failpoint.Eval`
+func (r *Rewriter) failpointSelector(pos token.Pos, name string) ast.Expr {
+	if r.failpointName == "." {
+		return &ast.Ident{NamePos: pos, Name: name}
+	}
+	return &ast.SelectorExpr{
+		X:   &ast.Ident{NamePos: pos, Name: r.failpointName},
+		Sel: ast.NewIdent(name),
+	}
 }
 
 // RewriteFile rewrites a single file
-func (r *Rewriter) RewriteFile(path string) (err error) {
+func (r *Rewriter) RewriteFile(path string) error {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return r.rewriteSource(path, src)
+}
+
+// rewriteSource rewrites the source of a file and writes the result
+func (r *Rewriter) rewriteSource(path string, src []byte) error {
+	entry, _, err := r.rewriteCached(path, src, r.writeMode())
+	if err != nil {
+		return err
+	}
+	if !entry.Rewritten {
+		return nil
+	}
+	return r.writeResult(path, src, entry.Package, entry.content)
+}
+
+// rewriteCached rewrites the source of a file syntactically in the write mode, the
+// result is reused if it has been cached, otherwise it is stored in the cache. The
+// key of the result is empty if the cache is not set.
+func (r *Rewriter) rewriteCached(path string, src []byte, mode string) (*cacheEntry, string, error) {
+	r.info = nil
+	var key string
+	if r.cache != nil {
+		var err error
+		if key, err = r.cacheKey(path, src, mode); err != nil {
+			return nil, "", err
+		}
+		if entry := r.cache.get(key); entry != nil {
+			for _, warning := range entry.Warnings {
+				r.log(warning, "file", path)
+			}
+			r.rewritten = entry.Rewritten
+			r.lineMap = entry.LineMap
+			return entry, key, nil
+		}
+	}
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := r.rewriteFile(path, fset, file); err != nil {
+		return nil, "", err
+	}
+	entry := &cacheEntry{Rewritten: r.rewritten, Warnings: r.warnings}
+	if r.rewritten {
+		if entry.content, err = r.renderFile(path, fset, file, src, mode); err != nil {
+			return nil, "", err
+		}
+		entry.Package = file.Name.Name
+		entry.LineMap = r.lineMap
+	}
+	if r.cache != nil {
+		if err := r.cache.put(key, entry); err != nil {
+			return nil, "", err
+		}
+	}
+	return entry, key, nil
+}
+
+// RewriteFileToCache rewrites a single file like RewriteFile with SetOutput, but the
+// result is stored in the cache instead of written to the output, see SetCache. It
+// returns the path of the rewritten file in the cache, which is empty if the file has
+// not been rewritten. A file is not rewritten again if its result has been cached, and
+// the files which do not mention the failpoint package are skipped without caching.
+func (r *Rewriter) RewriteFileToCache(path string) (string, error) {
+	if r.cache == nil {
+		return "", errors.New("the cache of the rewriter is not set")
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Contains(src, []byte(packagePath)) {
+		// the file can not import the failpoint package, it is neither parsed
+		// nor cached
+		r.rewritten = false
+		r.lineMap = nil
+		r.warnings = nil
+		return "", nil
+	}
+	entry, key, err := r.rewriteCached(path, src, writeModeOutput)
+	if err != nil {
+		return "", err
+	}
+	if !entry.Rewritten {
+		return "", nil
+	}
+	return r.cache.contentPath(key), nil
+}
+
+// rewriteFile rewrites the AST of a single file in place, the type information
+// in r.info is used to resolve the marker functions if it is not nil.
+func (r *Rewriter) rewriteFile(path string, fset *token.FileSet, file *ast.File) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("%s %v\n%s", r.currentPath, e, debug.Stack())
 		}
 	}()
-	fset := token.NewFileSet()
-	file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
-	if err != nil {
-		return err
-	}
+	r.rewritten = false
+	r.lineMap = nil
+	r.warnings = nil
 	if len(file.Decls) < 1 {
 		return nil
 	}
 	r.currentPath = path
 	r.currentFile = file
 	r.currsetFset = fset
-	r.rewritten = false
 
 	var failpointImport *ast.ImportSpec
 	for _, imp := range file.Imports {
@@ -632,110 +1111,517 @@ func (r *Rewriter) RewriteFile(path string) (err error) {
 	}
 
 	for _, decl := range file.Decls {
-		fn, ok := decl.(*ast.FuncDecl)
-		if !ok {
-			continue
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			err = r.rewriteFuncDecl(d)
+		case *ast.GenDecl:
+			err = r.rewriteGenDecl(d)
 		}
-		if err := r.rewriteFuncDecl(fn); err != nil {
+		if err != nil {
 			return err
 		}
 	}
+	return r.verifyMarkers(file)
+}
 
-	if !r.rewritten {
-		return nil
+// The write modes of the rewritten files, the line directives of the modes
+// refer to the original files differently
+const (
+	// writeModeOutput writes the files to the output, see SetOutput
+	writeModeOutput = "output"
+	// writeModeOverlay writes the files to the overlay directory, see SetOverlay
+	writeModeOverlay = "overlay"
+	// writeModeFile replaces the files, or writes them by the output function
+	writeModeFile = "file"
+)
+
+func (r *Rewriter) writeMode() string {
+	switch {
+	case r.output != nil:
+		return writeModeOutput
+	case r.overlay != nil:
+		return writeModeOverlay
+	default:
+		return writeModeFile
 	}
+}
 
+// renderFile formats the rewritten file with the line directives of the write mode
+func (r *Rewriter) renderFile(path string, fset *token.FileSet, file *ast.File, src []byte, mode string) ([]byte, error) {
+	lineFile := r.lineFile
+	if lineFile == "" {
+		var err error
+		switch mode {
+		case writeModeOutput:
+			// The output will be compiled in another place, e.g. a temporary
+			// folder of `failpoint-toolexec`, so the line directives must refer
+			// to the original file by the absolute path. The file name may have
+			// been changed by a line directive already, e.g. the file generated
+			// by `go tool cover`.
+			lineFile, err = filepath.Abs(fset.Position(file.Package).Filename)
+		case writeModeOverlay:
+			// The rewritten file is compiled in the overlay directory
+			lineFile, err = filepath.Abs(path)
+		default:
+			// The line directive is relative to the directory of the rewritten file
+			lineFile = filepath.Base(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := r.formatFile(&buf, fset, file, src, lineFile); err != nil {
+		return nil, err
+	}
+	r.lineMap.TypeCheck = r.info != nil
+	return buf.Bytes(), nil
+}
+
+// writeFile writes the rewritten file to the output if it is set, otherwise the
+// original file is stashed and replaced with the rewritten one.
+func (r *Rewriter) writeFile(path string, fset *token.FileSet, file *ast.File, src []byte) error {
+	content, err := r.renderFile(path, fset, file, src, r.writeMode())
+	if err != nil {
+		return err
+	}
+	return r.writeResult(path, src, file.Name.Name, content)
+}
+
+// writeResult writes the rewritten content of the file in the write mode, the
+// line map of the content is r.lineMap.
+func (r *Rewriter) writeResult(path string, src []byte, pkgName string, content []byte) (err error) {
 	if r.output != nil {
-		return format.Node(r.output, fset, file)
+		if _, err := r.output.Write(content); err != nil {
+			return err
+		}
+		r.recordWritten(path, false)
+		return nil
+	}
+
+	if r.overlay != nil {
+		if err := r.writeOverlay(path, pkgName, content); err != nil {
+			return err
+		}
+		r.recordWritten(path, false)
+		return nil
 	}
 
+	if r.outputFunc != nil {
+		var out io.Writer
+		r.locked(func() {
+			out, err = r.outputFunc(path)
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(content); err != nil {
+			return err
+		}
+		r.recordWritten(path, false)
+		return nil
+	}
+
+	// Every step is recorded in the journal before it is done, so that an
+	// interrupted rewriting can be rolled back by the Restorer
+	root := journalRoot(r.rewriteDir)
+
 	// Generate binding code
 	found, err := isBindingFileExists(path)
 	if err != nil {
 		return err
 	}
 	if !found {
-		err := writeBindingFile(path, file.Name.Name)
+		if err := appendJournal(root, journalBinding, failpointBindingPath(path), nil); err != nil {
+			return err
+		}
+		err := writeBindingFile(path, pkgName)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Backup origin file and replace content
+	if err := appendJournal(root, journalStash, path, src); err != nil {
+		return err
+	}
 	targetPath := path + failpointStashFileSuffix
 	if err := os.Rename(path, targetPath); err != nil {
 		return err
 	}
-
-	newFile, err := os.OpenFile(path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return err
+	}
+	if err := WriteLineMap(root, path, r.lineMap); err != nil {
 		return err
 	}
-	defer newFile.Close()
-	return format.Node(newFile, fset, file)
+	r.recordWritten(path, true)
+	return appendJournal(root, journalRewritten, path, nil)
 }
 
 // Rewrite does the rewrite action for specified path. It contains the main steps:
 //
-// 1. Filter out failpoint binding files and files that have no suffix `.go`
-// 2. Filter out files which have not imported failpoint package (implying no failpoints)
-// 3. Parse file to `ast.File` and rewrite the AST
+// 1. Walk the path and group the Go files by their directories, the directories
+// like `vendor`, `testdata` and `.git` are skipped, see SetSkipDirs, and the files
+// are filtered by the patterns, see SetInclude and SetExclude
+// 2. Filter out failpoint binding files and files which have not imported failpoint
+// package (implying no failpoints), each remained file is parsed only once
+// 3. Rewrite the AST of the files, the directories are rewritten concurrently, see SetWorkers
 // 4. Create failpoint binding file (which contains `_curpkg_` function) if it does not exist
 // 5. Rename original file to `original-file-name + __failpoint_stash__`
 // 6. Replace original file content base on the new AST
+//
+// In the type-aware mode, the packages are loaded with their type information instead
+// of parsing the files one by one, see SetTypeCheck.
 func (r *Rewriter) Rewrite() error {
-	var files []string
+	start := time.Now()
+	r.stats = RewriteStats{}
+	r.written = nil
+	defer func() {
+		r.stats.Elapsed = time.Since(start)
+	}()
+
+	if err := r.checkPatterns(); err != nil {
+		return err
+	}
+	dirs, err := r.goFileDirs()
+	if err != nil {
+		return err
+	}
+	for _, files := range dirs {
+		r.stats.Scanned += len(files)
+	}
+
+	// The files of a directory are rewritten by a worker one by one, so the
+	// binding file of a package is never generated twice
+	workers := r.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if r.output != nil {
+		// The rewritten files are written to the same writer in order
+		workers = 1
+	}
+	if workers > len(dirs) {
+		workers = len(dirs)
+	}
+	r.mu = &sync.Mutex{}
+	defer func() {
+		r.mu = nil
+	}()
+
+	// The files to rewrite in the type-aware mode, they are collected by
+	// directories to keep the order of the walk
+	typedFiles := make([][]string, len(dirs))
+	errs := make([]error, len(dirs))
+	var failed atomic.Bool
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fork := r.fork()
+			for index := range next {
+				if failed.Load() {
+					continue
+				}
+				typedFiles[index], errs[index] = fork.rewriteDirFiles(dirs[index])
+				if errs[index] != nil {
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	for index := range dirs {
+		next <- index
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.typeCheck {
+		var files []string
+		for _, dirFiles := range typedFiles {
+			files = append(files, dirFiles...)
+		}
+		if err := r.rewriteTyped(files); err != nil {
+			return err
+		}
+	}
+	if r.git && len(r.written) > 0 {
+		return hideFromGit(journalRoot(r.rewriteDir), r.written)
+	}
+	return nil
+}
+
+// fork returns a rewriter with the same options, which rewrites the files in
+// another goroutine. The files written by it are reported to r. The files which
+// have not imported the failpoint package are left untouched by the fork.
+func (r *Rewriter) fork() *Rewriter {
+	return &Rewriter{
+		rewriteDir:      r.rewriteDir,
+		allowNotChecked: true,
+		lineDirectives:  r.lineDirectives,
+		strict:          r.strict,
+		typeCheck:       r.typeCheck,
+		lineFile:        r.lineFile,
+		output:          r.output,
+		outputFunc:      r.outputFunc,
+		overlayDir:      r.overlayDir,
+		overlay:         r.overlay,
+		cache:           r.cache,
+		logger:          r.logger,
+		mu:              r.mu,
+		parent:          r,
+	}
+}
+
+// rewriteDirFiles rewrites the files of a directory in order. In the type-aware
+// mode, the files which have imported the failpoint package are returned instead.
+func (r *Rewriter) rewriteDirFiles(files []string) ([]string, error) {
+	var typed []string
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// The files which do not mention the package path are not parsed at all
+		if !bytes.Contains(src, []byte(packagePath)) {
+			continue
+		}
+		enabled, err := isEnabled(path)
+		if err != nil {
+			return nil, err
+		}
+		if !enabled && !r.typeCheck {
+			if err := r.rewriteSource(path, src); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		if !importsFailpoint(file) {
+			continue
+		}
+		if enabled {
+			if err := r.checkEnabled(path, file); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		typed = append(typed, path)
+	}
+	return typed, nil
+}
+
+// locked runs the function with the mutex of the concurrent rewriting held,
+// the function updates the states shared by the goroutines.
+func (r *Rewriter) locked(fn func()) {
+	if r.mu != nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+	}
+	fn()
+}
+
+// log reports the message to the logger, the messages of the forked rewriters
+// are serialized so that they do not interleave.
+func (r *Rewriter) log(msg string, keyvals ...interface{}) {
+	if r.logger == nil {
+		return
+	}
+	r.locked(func() {
+		r.logger.Log(msg, keyvals...)
+	})
+}
+
+// recordWritten records the file written by the rewriter, or by the forked one
+func (r *Rewriter) recordWritten(path string, inPlace bool) {
+	root := r
+	if r.parent != nil {
+		root = r.parent
+	}
+	root.locked(func() {
+		root.stats.Rewritten++
+		if inPlace {
+			root.written = append(root.written, path)
+		}
+	})
+}
+
+// goFileDirs returns the Go files under the rewrite path grouped by their
+// directories, the failpoint binding files, the skipped directories and the
+// files filtered out by the patterns are excluded. The rewrite path itself is
+// never skipped.
+func (r *Rewriter) goFileDirs() ([][]string, error) {
+	skipDirs := r.skipDirs
+	if skipDirs == nil {
+		skipDirs = DefaultSkipDirs
+	}
+	skipped := map[string]bool{}
+	for _, name := range skipDirs {
+		skipped[name] = true
+	}
+
+	var dirs [][]string
+	index := map[string]int{}
 	err := filepath.Walk(r.rewriteDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		if info.IsDir() {
+			if path != r.rewriteDir && (r.flat || skipped[info.Name()] || matchPatterns(r.exclude, r.relPath(path))) {
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		if !strings.HasSuffix(path, ".go") {
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, failpointBindingFileName) {
 			return nil
 		}
-		if strings.HasSuffix(path, failpointBindingFileName) {
+		rel := r.relPath(path)
+		if (len(r.include) > 0 && !matchPatterns(r.include, rel)) || matchPatterns(r.exclude, rel) {
 			return nil
 		}
-		// Will rewrite a file only if the file has imported "github.com/pingcap/failpoint"
-		fset := token.NewFileSet()
-		file, err := parser.ParseFile(fset, path, nil, parser.ImportsOnly)
-		if err != nil {
-			return err
+		dir := filepath.Dir(path)
+		i, found := index[dir]
+		if !found {
+			i = len(dirs)
+			index[dir] = i
+			dirs = append(dirs, nil)
 		}
-		if len(file.Imports) < 1 {
-			return nil
+		dirs[i] = append(dirs[i], path)
+		return nil
+	})
+	return dirs, err
+}
+
+// importsFailpoint returns whether the file has imported the failpoint package
+func importsFailpoint(file *ast.File) bool {
+	for _, imp := range file.Imports {
+		// import path maybe in the form of:
+		//
+		// 1. normal import
+		//    - "github.com/pingcap/failpoint"
+		//    - `github.com/pingcap/failpoint`
+		// 2. ignore import
+		//    - _ "github.com/pingcap/failpoint"
+		//    - _ `github.com/pingcap/failpoint`
+		// 3. alias import
+		//    - alias "github.com/pingcap/failpoint"
+		//    - alias `github.com/pingcap/failpoint`
+		// we should trim '"' or '`' before compare it.
+		if strings.Trim(imp.Path.Value, "`\"") == packagePath {
+			return true
 		}
-		for _, imp := range file.Imports {
-			// import path maybe in the form of:
-			//
-			// 1. normal import
-			//    - "github.com/pingcap/failpoint"
-			//    - `github.com/pingcap/failpoint`
-			// 2. ignore import
-			//    - _ "github.com/pingcap/failpoint"
-			//    - _ `github.com/pingcap/failpoint`
-			// 3. alias import
-			//    - alias "github.com/pingcap/failpoint"
-			//    - alias `github.com/pingcap/failpoint`
-			// we should trim '"' or '`' before compare it.
-			if strings.Trim(imp.Path.Value, "`\"") == packagePath {
+	}
+	return false
+}
+
+// failpointFiles returns the files which have imported the failpoint package under the path
+func failpointFiles(root string) ([]string, error) {
+	dirs, err := NewRewriter(root).goFileDirs()
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, dirFiles := range dirs {
+		for _, path := range dirFiles {
+			src, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Contains(src, []byte(packagePath)) {
+				continue
+			}
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, path, src, parser.ImportsOnly)
+			if err != nil {
+				return nil, err
+			}
+			if importsFailpoint(file) {
 				files = append(files, path)
-				break
 			}
 		}
-		return nil
-	})
+	}
+	return files, nil
+}
+
+// checkEnabled skips the file which has been rewritten already, so that enabling
+// a path twice is a no-op. The enabled file which has markers again, e.g. added
+// after the rewriting, is reported as an error instead of being stashed twice.
+func (r *Rewriter) checkEnabled(path string, file *ast.File) error {
+	if fileHasMarkers(file) {
+		return fmt.Errorf("%s has been enabled but has new markers, disable it before enabling again", path)
+	}
+	r.log(path+" has been enabled, skipped", "file", path)
+	return nil
+}
+
+// isEnabled returns whether the file has been rewritten, i.e. it has a stash file
+func isEnabled(path string) (bool, error) {
+	_, err := os.Stat(path + failpointStashFileSuffix)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// hasMarkers returns whether the file has markers to rewrite
+func hasMarkers(path string) (bool, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.SkipObjectResolution)
 	if err != nil {
-		return err
+		return false, err
 	}
+	return fileHasMarkers(file), nil
+}
 
-	for _, file := range files {
-		err := r.RewriteFile(file)
-		if err != nil {
-			return err
+// fileHasMarkers returns whether the parsed file calls any marker, e.g. the
+// `failpoint.Inject` selected from the failpoint import name. The AST is only
+// scanned, the markers are validated when the file is rewritten.
+func fileHasMarkers(file *ast.File) bool {
+	var failpointName string
+	for _, imp := range file.Imports {
+		if strings.Trim(imp.Path.Value, "`\"") == packagePath {
+			failpointName = packageName
+			if imp.Name != nil {
+				failpointName = imp.Name.Name
+			}
 		}
 	}
-	return nil
+	if failpointName == "" || failpointName == "_" {
+		return false
+	}
+	found := false
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if found || !ok {
+			return !found
+		}
+		fun := call.Fun
+		// The explicit instantiation of a generic marker, e.g. `failpoint.Override[int]`
+		switch v := fun.(type) {
+		case *ast.IndexExpr:
+			fun = v.X
+		case *ast.IndexListExpr:
+			fun = v.X
+		}
+		if sel, ok := fun.(*ast.SelectorExpr); ok {
+			if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == failpointName {
+				_, stmt := exprRewriters[sel.Sel.Name]
+				found = stmt || exprMarkers[sel.Sel.Name]
+			}
+		}
+		return true
+	})
+	return found
 }
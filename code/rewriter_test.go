@@ -16,6 +16,10 @@ package code_test
 
 import (
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -24,6 +28,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/pingcap/failpoint"
 	"github.com/pingcap/failpoint/code"
 )
 
@@ -2437,6 +2442,322 @@ func unittest() {
 	failpoint.Eval(_curpkg_("failpoint-name"))
 	failpoint.Eval(_curpkg_("failpoint-name"))
 }
+`,
+		},
+
+		{
+			filepath: "generic-and-select-send.go",
+			original: `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func apply[K comparable, V any](k K, fn func() V) V {
+	return fn()
+}
+
+func unittest(ch chan int) {
+	apply[string, int]("key", func() int {
+		failpoint.Inject("failpoint-name", func() {
+			failpoint.Return(1)
+		})
+		return 0
+	})
+	select {
+	case ch <- func() int {
+		failpoint.Inject("failpoint-name", func() {
+			failpoint.Return(1)
+		})
+		return 0
+	}():
+	}
+}
+`,
+			expected: `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func apply[K comparable, V any](k K, fn func() V) V {
+	return fn()
+}
+
+func unittest(ch chan int) {
+	apply[string, int]("key", func() int {
+		if _, _err_ := failpoint.Eval(_curpkg_("failpoint-name")); _err_ == nil {
+			return 1
+		}
+		return 0
+	})
+	select {
+	case ch <- func() int {
+		if _, _err_ := failpoint.Eval(_curpkg_("failpoint-name")); _err_ == nil {
+			return 1
+		}
+		return 0
+	}():
+	}
+}
+`,
+		},
+
+		{
+			filepath: "package-level-func-lit.go",
+			original: `
+package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+type handler struct {
+	name string
+	fn   func() int
+}
+
+var handle = func() {
+	failpoint.Inject("failpoint-name", func(val failpoint.Value) {
+		fmt.Println("unit-test", val)
+	})
+}
+
+var (
+	handlers = []handler{
+		{name: "h1", fn: func() int {
+			failpoint.Inject("failpoint-name", func() {
+				failpoint.Return(1)
+			})
+			return 0
+		}},
+	}
+	run = (&handler{fn: func() int {
+		failpoint.Inject("failpoint-name", nil)
+		return 0
+	}}).fn
+)
+
+func unittest() {
+	var h = handler{fn: func() int {
+		failpoint.Inject("failpoint-name", func() {
+			failpoint.Return(1)
+		})
+		return 0
+	}}
+	fmt.Println(h)
+}
+`,
+			expected: `
+package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+type handler struct {
+	name string
+	fn   func() int
+}
+
+var handle = func() {
+	if val, _err_ := failpoint.Eval(_curpkg_("failpoint-name")); _err_ == nil {
+		fmt.Println("unit-test", val)
+	}
+}
+
+var (
+	handlers = []handler{
+		{name: "h1", fn: func() int {
+			if _, _err_ := failpoint.Eval(_curpkg_("failpoint-name")); _err_ == nil {
+				return 1
+			}
+			return 0
+		}},
+	}
+	run = (&handler{fn: func() int {
+		failpoint.Eval(_curpkg_("failpoint-name"))
+		return 0
+	}}).fn
+)
+
+func unittest() {
+	var h = handler{fn: func() int {
+		if _, _err_ := failpoint.Eval(_curpkg_("failpoint-name")); _err_ == nil {
+			return 1
+		}
+		return 0
+	}}
+	fmt.Println(h)
+}
+`,
+		},
+
+		{
+			filepath: "override.go",
+			original: `
+package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func compute() int {
+	return 1
+}
+
+func unittest() int64 {
+	n := failpoint.Override("failpoint-name", compute())
+	fmt.Println(failpoint.Override("failpoint-name", n))
+	return failpoint.Override[int64]("failpoint-name", 1)
+}
+`,
+			expected: `
+package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func compute() int {
+	return 1
+}
+
+func unittest() int64 {
+	n := failpoint.EvalOverride(_curpkg_("failpoint-name"), compute())
+	fmt.Println(failpoint.EvalOverride(_curpkg_("failpoint-name"), n))
+	return failpoint.EvalOverride[int64](_curpkg_("failpoint-name"), 1)
+}
+`,
+		},
+
+		{
+			filepath: "select.go",
+			original: `
+package rewriter_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest(ch chan int, out chan<- int) {
+	select {
+	case v, ok := <-ch:
+		fmt.Println(v, ok)
+	case out <- 1:
+	case <-failpoint.Case("failpoint-name", time.After(time.Second)):
+		failpoint.Inject("failpoint-name2", func() {
+			fmt.Println("unit-test")
+		})
+	default:
+	}
+loop:
+	select {
+	case <-ch:
+		break loop
+	case <-failpoint.After("failpoint-name"):
+		return
+	}
+}
+`,
+			expected: `
+package rewriter_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest(ch chan int, out chan<- int) {
+	{
+		_sel_ := failpoint.EvalSelect(_curpkg_("failpoint-name"))
+		select {
+		case v, ok := <-failpoint.SelectOther(_sel_, ch):
+			fmt.Println(v, ok)
+		case failpoint.SelectOther(_sel_, out) <- 1:
+		case <-failpoint.SelectCase(_sel_, time.After(time.Second)):
+			if _, _err_ := failpoint.Eval(_curpkg_("failpoint-name2")); _err_ == nil {
+				fmt.Println("unit-test")
+			}
+		default:
+		}
+	}
+	{
+		_sel_ := failpoint.EvalSelect(_curpkg_("failpoint-name"))
+	loop:
+		select {
+		case <-failpoint.SelectOther(_sel_, ch):
+			break loop
+		case <-failpoint.SelectAfter(_sel_):
+			return
+		}
+	}
+}
+`,
+		},
+
+		{
+			filepath: "typed-closure.go",
+			original: `
+package rewriter_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest(ctx context.Context) {
+	failpoint.Inject("failpoint-name", func(n int) {
+		fmt.Println("unit-test", n)
+	})
+	failpoint.InjectContext(ctx, "failpoint-name", func(d time.Duration) {
+		time.Sleep(d)
+	})
+	failpoint.Inject("failpoint-name", func(err error) {
+		fmt.Println("unit-test", err)
+	})
+}
+`,
+			expected: `
+package rewriter_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest(ctx context.Context) {
+	if n, _err_ := failpoint.EvalAs[int](_curpkg_("failpoint-name")); _err_ == nil {
+		fmt.Println("unit-test", n)
+	}
+	if d, _err_ := failpoint.EvalContextAs[time.Duration](ctx, _curpkg_("failpoint-name")); _err_ == nil {
+		time.Sleep(d)
+	}
+	if err, _err_ := failpoint.EvalAs[error](_curpkg_("failpoint-name")); _err_ == nil {
+		fmt.Println("unit-test", err)
+	}
+}
 `,
 		},
 	}
@@ -2496,7 +2817,7 @@ import (
 )
 
 func unittest() {
-	failpoint.Inject("failpoint-name", func(val int) {
+	failpoint.Inject("failpoint-name", func(val ...int) {
 		fmt.Println("unit-test", val)
 	})
 }
@@ -3597,58 +3918,245 @@ label:
 }
 `,
 		},
-	}
 
-	// Create temp files
-	err := os.MkdirAll(rewritePath, 0755)
-	require.NoError(t, err)
-	for _, cs := range cases {
-		original := filepath.Join(rewritePath, cs.filepath)
-		err := ioutil.WriteFile(original, []byte(cs.original), 0644)
-		require.NoError(t, err)
-	}
-
-	// Clean all temp files
-	defer func() {
-		err := os.RemoveAll(rewritePath)
-		require.NoError(t, err)
-	}()
+		{
+			filepath: "bad-return-arity.go",
+			errormsg: `failpoint\.Return: expect 2 results but got 1 in .*bad-return-arity\.go:10`,
+			original: `
+package rewriter_test
 
-	// Workspace should keep clean if some error occurred
-	for _, cs := range cases {
-		original := filepath.Join(rewritePath, cs.filepath)
-		rewriter := code.NewRewriter(original)
-		err = rewriter.Rewrite()
-		require.Error(t, err)
-		require.Regexp(t, cs.errormsg, err.Error(), "%v", cs.filepath)
+import (
+	"github.com/pingcap/failpoint"
+)
 
-		content, err := ioutil.ReadFile(original)
-		require.NoError(t, err)
-		require.Equalf(t, cs.original, string(content), "%v", cs.filepath)
-	}
+func unittest() (int, error) {
+	failpoint.Inject("failpoint-name", func() {
+		failpoint.Return(1)
+	})
+	return 0, nil
 }
-
-func TestRewriteInjectCall(t *testing.T) {
-	cases := []rewriteCase{
+`,
+		},
 
 		{
-			filepath: "test.go",
+			filepath: "bad-return-go-closure.go",
+			errormsg: `failpoint\.Return: return from the go closure instead of the enclosing function in .*bad-return-go-closure\.go:11`,
 			original: `
 package rewriter_test
 
 import (
-	"fmt"
-
 	"github.com/pingcap/failpoint"
 )
 
-func main() {
-	var (
-		a int
-		b string
-		c []float64
-	)
-	a, b, c = 1, "hello", []float64{1.0, 2.0}
+func unittest() {
+	go func() {
+		failpoint.Inject("failpoint-name", func() {
+			failpoint.Return()
+		})
+	}()
+}
+`,
+		},
+
+		{
+			filepath: "bad-return-defer-closure.go",
+			errormsg: `failpoint\.Return: return from the defer closure instead of the enclosing function in .*bad-return-defer-closure\.go:11`,
+			original: `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() int {
+	defer func() {
+		failpoint.Inject("failpoint-name", func() {
+			failpoint.Return(1)
+		})
+	}()
+	return 0
+}
+`,
+		},
+
+		{
+			filepath: "bad-break-no-loop.go",
+			errormsg: `failpoint\.Break: no enclosing loop, switch or select in .*bad-break-no-loop\.go:10`,
+			original: `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", func() {
+		failpoint.Break()
+	})
+}
+`,
+		},
+
+		{
+			filepath: "bad-continue-unknown-label.go",
+			errormsg: `failpoint\.Continue: unknown label inner in .*bad-continue-unknown-label\.go:12`,
+			original: `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+outer:
+	for i := 0; i < 10; i++ {
+		failpoint.Inject("failpoint-name", func() {
+			failpoint.Continue("inner")
+		})
+	}
+}
+`,
+		},
+
+		{
+			filepath: "bad-continue-not-loop.go",
+			errormsg: `failpoint\.Continue: label outer is not a loop in .*bad-continue-not-loop\.go:12`,
+			original: `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest(x int) {
+	failpoint.Label("outer")
+	switch x {
+	case 1:
+		failpoint.Continue("outer")
+	}
+}
+`,
+		},
+
+		{
+			filepath: "bad-override.go",
+			errormsg: `failpoint\.Override: expect 2 arguments but got 1 in .*bad-override\.go:9`,
+			original: `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() int {
+	return failpoint.Override[int]("failpoint-name")
+}
+`,
+		},
+
+		{
+			filepath: "bad-select-cases.go",
+			errormsg: `failpoint\.After: only one case of a select can be marked in .*bad-select-cases\.go:11`,
+			original: `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest(ch chan int) {
+	select {
+	case <-failpoint.Case("failpoint-name", ch):
+	case <-failpoint.After("failpoint-name2"):
+	}
+}
+`,
+		},
+
+		{
+			filepath: "bad-select-marker.go",
+			errormsg: `failpoint\.Case: marker can not be rewritten in .*bad-select-marker\.go:9`,
+			original: `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest(ch chan int) {
+	v := <-failpoint.Case("failpoint-name", ch)
+	_ = v
+}
+`,
+		},
+
+		{
+			filepath: "bad-unrewritable-marker.go",
+			errormsg: `failpoint\.Inject: marker can not be rewritten in .*bad-unrewritable-marker\.go:9`,
+			original: `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	defer failpoint.Inject("failpoint-name", nil)
+}
+`,
+		},
+	}
+
+	// Create temp files
+	err := os.MkdirAll(rewritePath, 0755)
+	require.NoError(t, err)
+	for _, cs := range cases {
+		original := filepath.Join(rewritePath, cs.filepath)
+		err := ioutil.WriteFile(original, []byte(cs.original), 0644)
+		require.NoError(t, err)
+	}
+
+	// Clean all temp files
+	defer func() {
+		err := os.RemoveAll(rewritePath)
+		require.NoError(t, err)
+	}()
+
+	// Workspace should keep clean if some error occurred
+	for _, cs := range cases {
+		original := filepath.Join(rewritePath, cs.filepath)
+		rewriter := code.NewRewriter(original)
+		err = rewriter.Rewrite()
+		require.Error(t, err)
+		require.Regexp(t, cs.errormsg, err.Error(), "%v", cs.filepath)
+
+		content, err := ioutil.ReadFile(original)
+		require.NoError(t, err)
+		require.Equalf(t, cs.original, string(content), "%v", cs.filepath)
+	}
+}
+
+func TestRewriteInjectCall(t *testing.T) {
+	cases := []rewriteCase{
+
+		{
+			filepath: "test.go",
+			original: `
+package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func main() {
+	var (
+		a int
+		b string
+		c []float64
+	)
+	a, b, c = 1, "hello", []float64{1.0, 2.0}
 	failpoint.InjectCall("test", a, b, c)
 }
 `,
@@ -3709,3 +4217,552 @@ func main() {
 		})
 	}
 }
+
+func TestRewriteLineDirectives(t *testing.T) {
+	original := `
+package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", func(
+		val failpoint.Value,
+	) {
+		fmt.Println("unit-test", val)
+	})
+	fmt.Println("after")
+	failpoint.Inject("failpoint-name2", func() {
+		s := ` + "`multi\nline`" + `
+		fmt.Println(s)
+	})
+	failpoint.Inject("failpoint-name3", nil)
+	fmt.Println("end")
+}
+`
+	tempDir := t.TempDir()
+	fileName := filepath.Join(tempDir, "line-directives.go")
+	require.NoError(t, os.WriteFile(fileName, []byte(original), 0644))
+
+	rewriter := code.NewRewriter(tempDir)
+	rewriter.SetLineDirectives(true)
+	require.NoError(t, rewriter.Rewrite())
+
+	content, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "\n//line line-directives.go:")
+
+	// Every call in the rewritten file must be reported at its original line
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, fileName, content, 0)
+	require.NoError(t, err)
+	lines := map[string]int{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok && len(call.Args) > 0 {
+			if lit, ok := call.Args[0].(*ast.BasicLit); ok {
+				pos := fset.Position(call.Pos())
+				require.Equal(t, fileName, pos.Filename)
+				lines[lit.Value] = pos.Line
+			}
+		}
+		return true
+	})
+	require.Equal(t, map[string]int{
+		`"failpoint-name"`:  11,
+		`"unit-test"`:       14,
+		`"after"`:           16,
+		`"failpoint-name2"`: 17,
+		`"failpoint-name3"`: 22,
+		`"end"`:             23,
+	}, lines)
+
+	restorer := code.NewRestorer(tempDir)
+	require.NoError(t, restorer.Restore())
+	content, err = os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, original, string(content))
+}
+
+func TestRewriteStrict(t *testing.T) {
+	original := `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	defer failpoint.Inject("failpoint-name", nil)
+	go failpoint.Inject("failpoint-name", nil)
+	inject := failpoint.Inject
+	inject("failpoint-name", nil)
+}
+`
+	tempDir := t.TempDir()
+	fileName := filepath.Join(tempDir, "strict.go")
+	require.NoError(t, os.WriteFile(fileName, []byte(original), 0644))
+
+	// All the markers left are reported
+	rewriter := code.NewRewriter(tempDir)
+	err := rewriter.Rewrite()
+	require.Error(t, err)
+	require.Equal(t, strings.Join([]string{
+		"failpoint.Inject: marker can not be rewritten in " + fileName + ":9",
+		"failpoint.Inject: marker can not be rewritten in " + fileName + ":10",
+	}, "\n"), err.Error())
+
+	// The markers referenced without being called are reported in strict mode
+	rewriter = code.NewRewriter(tempDir)
+	rewriter.SetStrict(true)
+	err = rewriter.Rewrite()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failpoint.Inject: marker must be called directly in "+fileName+":11")
+
+	content, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, original, string(content))
+}
+
+func TestRewriteOutputFunc(t *testing.T) {
+	original := `
+package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	fmt.Println("begin")
+	failpoint.Inject("failpoint-name", func() {
+		fmt.Println("unit-test")
+	})
+}
+`
+	unchanged := `
+package rewriter_test
+
+import (
+	_ "github.com/pingcap/failpoint"
+)
+`
+	tempDir := t.TempDir()
+	fileName := filepath.Join(tempDir, "output-func.go")
+	require.NoError(t, os.WriteFile(fileName, []byte(original), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "unchanged.go"), []byte(unchanged), 0644))
+
+	// Only the rewritten files are written to the outputs
+	outputs := map[string]*strings.Builder{}
+	rewriter := code.NewRewriter(tempDir)
+	rewriter.SetLineDirectives(true)
+	rewriter.SetOutputFunc(func(path string) (io.Writer, error) {
+		outputs[path] = &strings.Builder{}
+		return outputs[path], nil
+	})
+	require.NoError(t, rewriter.Rewrite())
+	require.Len(t, outputs, 1)
+	require.Contains(t, outputs, fileName)
+
+	// The tree is not modified
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// The output is the same as the file rewritten in place
+	rewriter = code.NewRewriter(tempDir)
+	rewriter.SetLineDirectives(true)
+	require.NoError(t, rewriter.Rewrite())
+	content, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, string(content), outputs[fileName].String())
+	require.NoError(t, code.NewRestorer(tempDir).Restore())
+}
+
+func TestRewriteEnabled(t *testing.T) {
+	original := `
+package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", func() {
+		fmt.Println("unit-test")
+	})
+}
+`
+	tempDir := t.TempDir()
+	fileName := filepath.Join(tempDir, "enabled.go")
+	require.NoError(t, os.WriteFile(fileName, []byte(original), 0644))
+	require.NoError(t, code.NewRewriter(tempDir).Rewrite())
+	rewritten, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+
+	// Enabling twice is a no-op
+	var logged []string
+	rewriter := code.NewRewriter(tempDir)
+	rewriter.SetLogger(failpoint.LoggerFunc(func(msg string, _ ...interface{}) {
+		logged = append(logged, msg)
+	}))
+	require.NoError(t, rewriter.Rewrite())
+	require.Equal(t, []string{fileName + " has been enabled, skipped"}, logged)
+	content, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, string(rewritten), string(content))
+	_, err = os.Stat(fileName + "__failpoint_stash____failpoint_stash__")
+	require.True(t, os.IsNotExist(err))
+
+	// The new markers in the enabled files are reported
+	modified := strings.Replace(string(rewritten), "func unittest() {", "func unittest() {\n\tfailpoint.Inject(\"failpoint-name2\", nil)", 1)
+	require.NoError(t, os.WriteFile(fileName, []byte(modified), 0644))
+	err = code.NewRewriter(tempDir).Rewrite()
+	require.Error(t, err)
+	require.Equal(t, fileName+" has been enabled but has new markers, disable it before enabling again", err.Error())
+	content, err = os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, modified, string(content))
+}
+
+func TestRewriteOverlay(t *testing.T) {
+	original := `
+package rewriter_test
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	fmt.Println("begin")
+	failpoint.Inject("failpoint-name", func() {
+		fmt.Println("unit-test")
+	})
+	fmt.Println("end")
+}
+`
+	tempDir := t.TempDir()
+	fileName := filepath.Join(tempDir, "overlay.go")
+	require.NoError(t, os.WriteFile(fileName, []byte(original), 0644))
+
+	overlayDir := t.TempDir()
+	overlay := &code.Overlay{}
+	rewriter := code.NewRewriter(tempDir)
+	rewriter.SetLineDirectives(true)
+	rewriter.SetOverlay(overlayDir, overlay)
+	require.NoError(t, rewriter.Rewrite())
+
+	// The tree is not modified
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	bindingFile := filepath.Join(tempDir, "binding__failpoint_binding__.go")
+	// The volume name is a directory without the colon, e.g. `C` for `C:` on Windows
+	overlayPath := func(path string) string {
+		volume := filepath.VolumeName(path)
+		return filepath.Join(overlayDir, strings.TrimSuffix(volume, ":"), path[len(volume):])
+	}
+	require.Equal(t, map[string]string{
+		fileName:    overlayPath(fileName),
+		bindingFile: overlayPath(bindingFile),
+	}, overlay.Replace)
+	content, err := os.ReadFile(overlay.Replace[fileName])
+	require.NoError(t, err)
+	require.Contains(t, string(content), "failpoint.Eval(_curpkg_(\"failpoint-name\"))")
+	require.Contains(t, string(content), "\n//line "+fileName+":")
+	content, err = os.ReadFile(overlay.Replace[bindingFile])
+	require.NoError(t, err)
+	require.Contains(t, string(content), "func _curpkg_(name string) string {")
+
+	overlayFile := filepath.Join(overlayDir, "overlay.json")
+	require.NoError(t, code.WriteOverlay(overlayFile, overlay))
+	content, err = os.ReadFile(overlayFile)
+	require.NoError(t, err)
+	require.Contains(t, string(content), `"Replace": {`)
+}
+
+func TestRewriteConcurrently(t *testing.T) {
+	const source = `
+package %s
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", func() {
+		fmt.Println("unit-test")
+	})
+}
+`
+	tempDir := t.TempDir()
+	var rewritten []string
+	for i := 0; i < 8; i++ {
+		pkg := fmt.Sprintf("pkg%d", i)
+		for _, name := range []string{"a.go", "b.go"} {
+			path := filepath.Join(tempDir, pkg, name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+			require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(source, pkg)), 0644))
+			rewritten = append(rewritten, path)
+		}
+	}
+	// The files in the skipped directories are never rewritten
+	var skipped []string
+	for _, dir := range []string{"vendor/dep", "testdata", "pkg0/testdata"} {
+		path := filepath.Join(tempDir, dir, "skipped.go")
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(source, "skipped")), 0644))
+		skipped = append(skipped, path)
+	}
+	plain := filepath.Join(tempDir, "plain.go")
+	require.NoError(t, os.WriteFile(plain, []byte("package plain\n"), 0644))
+
+	rewriter := code.NewRewriter(tempDir)
+	rewriter.SetWorkers(4)
+	require.NoError(t, rewriter.Rewrite())
+	stats := rewriter.Stats()
+	require.Equal(t, len(rewritten), stats.Rewritten)
+	require.Equal(t, len(rewritten)+1, stats.Scanned)
+
+	for _, path := range rewritten {
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Contains(t, string(content), "failpoint.Eval(_curpkg_(\"failpoint-name\"))")
+		_, err = os.Stat(filepath.Join(filepath.Dir(path), "binding__failpoint_binding__.go"))
+		require.NoError(t, err)
+	}
+	for _, path := range skipped {
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf(source, "skipped"), string(content))
+	}
+
+	// A skipped directory is rewritten if it is the rewrite path itself
+	testdata := filepath.Join(tempDir, "testdata")
+	rewriter = code.NewRewriter(testdata)
+	require.NoError(t, rewriter.Rewrite())
+	require.Equal(t, 1, rewriter.Stats().Rewritten)
+
+	require.NoError(t, code.NewRestorer(tempDir).Restore())
+	for _, path := range append(rewritten, skipped...) {
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NotContains(t, string(content), "_curpkg_")
+	}
+}
+
+func TestRewritePatterns(t *testing.T) {
+	const source = `
+package %s
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", nil)
+}
+`
+	tempDir := t.TempDir()
+	write := func(name string) string {
+		path := filepath.Join(tempDir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(source, filepath.Base(filepath.Dir(path)))), 0644))
+		return path
+	}
+	files := map[string]string{}
+	for _, name := range []string{"pkg/a.go", "pkg/a_gen.go", "pkg/mocks/m.go", "pkg/sub/s.go", "other/o.go"} {
+		files[name] = write(name)
+	}
+	rewrite := func(path string, recursive bool, include, exclude []string) []string {
+		rewriter := code.NewRewriter(path)
+		rewriter.SetRecursive(recursive)
+		rewriter.SetInclude(include)
+		rewriter.SetExclude(exclude)
+		require.NoError(t, rewriter.Rewrite())
+		var rewritten []string
+		for name, file := range files {
+			content, err := os.ReadFile(file)
+			require.NoError(t, err)
+			if strings.Contains(string(content), "_curpkg_") {
+				rewritten = append(rewritten, name)
+			}
+		}
+		require.NoError(t, code.NewRestorer(tempDir).Restore())
+		return rewritten
+	}
+
+	require.ElementsMatch(t, []string{"pkg/a.go", "pkg/sub/s.go"},
+		rewrite(tempDir, true, []string{"pkg"}, []string{"*_gen.go", "mocks"}))
+	require.ElementsMatch(t, []string{"pkg/a_gen.go", "pkg/mocks/m.go", "other/o.go"},
+		rewrite(tempDir, true, nil, []string{"pkg/a.go", "pkg/sub/"}))
+	require.ElementsMatch(t, []string{"pkg/a.go", "pkg/a_gen.go"},
+		rewrite(filepath.Join(tempDir, "pkg"), false, nil, nil))
+
+	rewriter := code.NewRewriter(tempDir)
+	rewriter.SetExclude([]string{"["})
+	require.EqualError(t, rewriter.Rewrite(), `invalid pattern "[": syntax error in pattern`)
+
+	require.True(t, code.IsPackagePattern("./pkg/..."))
+	require.True(t, code.IsPackagePattern("github.com/pingcap/failpoint/code"))
+	require.False(t, code.IsPackagePattern("./pkg"))
+	require.False(t, code.IsPackagePattern(tempDir))
+	// A relative directory is a path, which is rewritten with its subdirectories
+	require.ElementsMatch(t, []string{"pkg/a.go", "pkg/a_gen.go", "pkg/mocks/m.go", "pkg/sub/s.go"},
+		rewrite(filepath.Join(tempDir, "pkg"), true, nil, nil))
+	// The mistyped paths are not taken as import paths
+	require.False(t, code.IsPackagePattern("pkgg"))
+	require.False(t, code.IsPackagePattern("pkg/subb"))
+	require.True(t, code.IsPackagePattern("example.com/pkg"))
+	dirs, err := code.PackageDirs("..", "./examples/...")
+	require.NoError(t, err)
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(filepath.Dir(wd), "examples", "injectcall")}, dirs)
+}
+
+func TestRewriteTypeCheck(t *testing.T) {
+	// The packages must be in the module to be loaded
+	typedPath := "tmp/typed/"
+	defer func() {
+		require.NoError(t, os.RemoveAll(typedPath))
+	}()
+
+	cases := []rewriteCase{
+		{
+			filepath: "dot-import.go",
+			original: `
+package typed
+
+import (
+	"fmt"
+
+	. "github.com/pingcap/failpoint"
+)
+
+type injector struct{}
+
+func (injector) Inject(name string, fn func()) {}
+
+func unittest() {
+	Inject("failpoint-name", func(val Value) {
+		fmt.Println("unit-test", val)
+	})
+}
+`,
+			expected: `
+package typed
+
+import (
+	"fmt"
+
+	. "github.com/pingcap/failpoint"
+)
+
+type injector struct{}
+
+func (injector) Inject(name string, fn func()) {}
+
+func unittest() {
+	if val, _err_ := Eval(_curpkg_("failpoint-name")); _err_ == nil {
+		fmt.Println("unit-test", val)
+	}
+}
+`,
+		},
+		{
+			filepath: "shadowed.go",
+			original: `
+package typed
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func shadowed() {
+	failpoint.Inject("failpoint-name", nil)
+	{
+		failpoint := injector{}
+		failpoint.Inject("shadowed", func() {})
+	}
+}
+`,
+			expected: `
+package typed
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func shadowed() {
+	failpoint.Eval(_curpkg_("failpoint-name"))
+	{
+		failpoint := injector{}
+		failpoint.Inject("shadowed", func() {})
+	}
+}
+`,
+		},
+	}
+	goodPath := filepath.Join(typedPath, "good")
+	require.NoError(t, os.MkdirAll(goodPath, 0755))
+	for _, cs := range cases {
+		require.NoError(t, os.WriteFile(filepath.Join(goodPath, cs.filepath), []byte(cs.original), 0644))
+	}
+
+	rewriter := code.NewRewriter(goodPath)
+	rewriter.SetTypeCheck(true)
+	require.NoError(t, rewriter.Rewrite())
+	for _, cs := range cases {
+		content, err := os.ReadFile(filepath.Join(goodPath, cs.filepath))
+		require.NoError(t, err)
+		require.Equalf(t, strings.TrimSpace(cs.expected), strings.TrimSpace(string(content)), "%v", cs.filepath)
+	}
+
+	restorer := code.NewRestorer(goodPath)
+	require.NoError(t, restorer.Restore())
+	for _, cs := range cases {
+		content, err := os.ReadFile(filepath.Join(goodPath, cs.filepath))
+		require.NoError(t, err)
+		require.Equal(t, cs.original, string(content))
+	}
+
+	// The type errors of the rewritten code are reported before writing any file
+	original := `
+package typed
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() (int, error) {
+	failpoint.Inject("failpoint-name", func() {
+		failpoint.Return("1", nil)
+	})
+	return 0, nil
+}
+`
+	badPath := filepath.Join(typedPath, "bad")
+	require.NoError(t, os.MkdirAll(badPath, 0755))
+	fileName := filepath.Join(badPath, "return.go")
+	require.NoError(t, os.WriteFile(fileName, []byte(original), 0644))
+
+	rewriter = code.NewRewriter(badPath)
+	rewriter.SetTypeCheck(true)
+	err := rewriter.Rewrite()
+	require.Error(t, err)
+	require.Regexp(t, `return\.go:10:\d+: cannot use "1"`, err.Error())
+
+	content, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, original, string(content))
+}
@@ -0,0 +1,179 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// State is the state of a path rewritten by `failpoint-ctl enable`
+type State int
+
+const (
+	// StateClean means no file under the path has been rewritten
+	StateClean State = iota
+	// StateEnabled means all the markers under the path have been rewritten
+	StateEnabled
+	// StatePartial means some of the markers have not been rewritten, or the
+	// generated files are left by an interrupted `failpoint-ctl enable` or
+	// `failpoint-ctl disable`
+	StatePartial
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClean:
+		return "clean"
+	case StateEnabled:
+		return "enabled"
+	default:
+		return "partial"
+	}
+}
+
+// Status reports the files of a path rewritten by `failpoint-ctl enable`
+type Status struct {
+	State State
+	// Enabled are the rewritten files
+	Enabled []string
+	// Pending are the files which have markers to rewrite
+	Pending []string
+	// Orphans are the generated files which do not belong to any rewritten
+	// file, and the files interrupted during the rewriting
+	Orphans []string
+}
+
+// GetStatus returns the status of the path rewritten by `failpoint-ctl enable`
+func GetStatus(path string) (*Status, error) {
+	var generated []string
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, failpointStashFileSuffix) ||
+			strings.HasSuffix(path, failpointBindingFileName) ||
+			isLineMapFile(path) {
+			generated = append(generated, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	files, err := failpointFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{}
+	enabledDirs := map[string]bool{}
+	for _, file := range files {
+		enabled, err := isEnabled(file)
+		if err != nil {
+			return nil, err
+		}
+		marked, err := hasMarkers(file)
+		if err != nil {
+			return nil, err
+		}
+		if enabled {
+			status.Enabled = append(status.Enabled, file)
+			enabledDirs[filepath.Dir(file)] = true
+		}
+		if marked {
+			status.Pending = append(status.Pending, file)
+		}
+	}
+	for _, file := range generated {
+		var owner string
+		switch {
+		case strings.HasSuffix(file, failpointBindingFileName):
+			if enabledDirs[filepath.Dir(file)] {
+				continue
+			}
+		case strings.HasSuffix(file, failpointStashFileSuffix):
+			owner = strings.TrimSuffix(file, failpointStashFileSuffix)
+		default:
+			owner, _ = lineMapOwner(file)
+		}
+		if owner != "" {
+			if _, err := os.Stat(owner + failpointStashFileSuffix); err == nil {
+				if _, err := os.Stat(owner); err == nil {
+					continue
+				}
+			}
+		}
+		status.Orphans = append(status.Orphans, file)
+	}
+
+	// The files stashed but not completely rewritten by an interrupted rewriting
+	roots, err := journalRoots(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []journalEntry
+	for _, root := range roots {
+		rootEntries, err := readJournal(root)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, rootEntries...)
+	}
+	rewritten := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Op == journalRewritten {
+			rewritten[entry.Path] = true
+		}
+	}
+	for _, entry := range entries {
+		if entry.Op != journalStash || rewritten[entry.Path] {
+			continue
+		}
+		if _, err := os.Stat(entry.Path + failpointStashFileSuffix); err == nil {
+			status.Orphans = append(status.Orphans, entry.Path)
+		}
+	}
+
+	switch {
+	case len(generated) == 0 && len(entries) == 0:
+		status.State = StateClean
+	case len(status.Pending) == 0 && len(status.Orphans) == 0:
+		status.State = StateEnabled
+	default:
+		status.State = StatePartial
+	}
+	return status, nil
+}
+
+// Conflicts returns the files which prevent the path from being enabled again,
+// which are the orphans and the enabled files with new markers.
+func (s *Status) Conflicts() []string {
+	pending := map[string]bool{}
+	for _, file := range s.Pending {
+		pending[file] = true
+	}
+	conflicts := append([]string(nil), s.Orphans...)
+	for _, file := range s.Enabled {
+		if pending[file] {
+			conflicts = append(conflicts, file)
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,126 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/failpoint/code"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	original := `
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func unittest() {
+	failpoint.Inject("failpoint-name", nil)
+}
+`
+	tempDir := t.TempDir()
+	fileA := filepath.Join(tempDir, "a.go")
+	require.NoError(t, os.WriteFile(fileA, []byte(original), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(tempDir, "sub"), 0755))
+	fileB := filepath.Join(tempDir, "sub", "b.go")
+	require.NoError(t, os.WriteFile(fileB, []byte(original), 0644))
+
+	status, err := code.GetStatus(tempDir)
+	require.NoError(t, err)
+	require.Equal(t, code.StateClean, status.State)
+	require.Equal(t, []string{fileA, fileB}, status.Pending)
+
+	// Only the sub directory is enabled
+	require.NoError(t, code.NewRewriter(filepath.Join(tempDir, "sub")).Rewrite())
+	status, err = code.GetStatus(tempDir)
+	require.NoError(t, err)
+	require.Equal(t, code.StatePartial, status.State)
+	require.Equal(t, []string{fileB}, status.Enabled)
+	require.Equal(t, []string{fileA}, status.Pending)
+	require.Empty(t, status.Conflicts())
+
+	require.NoError(t, code.NewRewriter(tempDir).Rewrite())
+	status, err = code.GetStatus(tempDir)
+	require.NoError(t, err)
+	require.Equal(t, code.StateEnabled, status.State)
+	require.Equal(t, []string{fileA, fileB}, status.Enabled)
+	require.Empty(t, status.Pending)
+
+	// The stash file without its rewritten file
+	require.NoError(t, os.Remove(fileA))
+	status, err = code.GetStatus(tempDir)
+	require.NoError(t, err)
+	require.Equal(t, code.StatePartial, status.State)
+	lineMapA := filepath.Join(tempDir, "__failpoint_linemaps__", "a.go.json")
+	require.Equal(t, []string{
+		lineMapA,
+		fileA + "__failpoint_stash__",
+		filepath.Join(tempDir, "binding__failpoint_binding__.go"),
+	}, status.Conflicts())
+
+	require.NoError(t, os.Rename(fileA+"__failpoint_stash__", fileA))
+	require.NoError(t, os.Remove(lineMapA))
+	require.NoError(t, code.NewRestorer(tempDir).Restore())
+	status, err = code.GetStatus(tempDir)
+	require.NoError(t, err)
+	require.Equal(t, code.StateClean, status.State)
+	// The journals of the sub paths are removed too
+	_, err = os.Stat(filepath.Join(tempDir, "sub", "__failpoint_journal__"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestStatusBadMarkers(t *testing.T) {
+	tempDir := t.TempDir()
+	fileName := filepath.Join(tempDir, "bad.go")
+	require.NoError(t, os.WriteFile(fileName, []byte(`
+package rewriter_test
+
+import (
+	fp "github.com/pingcap/failpoint"
+)
+
+func unittest(ch chan int) {
+	select {
+	case <-fp.Case("failpoint-name", ch):
+	case <-fp.After("failpoint-name2"):
+	}
+}
+`), 0644))
+	plainName := filepath.Join(tempDir, "plain.go")
+	require.NoError(t, os.WriteFile(plainName, []byte(`
+package rewriter_test
+
+import (
+	"github.com/pingcap/failpoint"
+)
+
+func plain() {
+	_ = failpoint.Enable("failpoint-name", "return")
+}
+`), 0644))
+
+	// The markers are reported without being rewritten, the errors of the
+	// markers are only reported by the rewriting
+	status, err := code.GetStatus(tempDir)
+	require.NoError(t, err)
+	require.Equal(t, code.StateClean, status.State)
+	require.Equal(t, []string{fileName}, status.Pending)
+	require.Error(t, code.NewRewriter(tempDir).Rewrite())
+}
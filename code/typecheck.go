@@ -0,0 +1,266 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package code
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// loadMode loads the dependencies from source, so that the type information does
+// not depend on the export data format of the installed Go version
+const loadMode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
+	packages.NeedImports | packages.NeedDeps | packages.NeedTypes | packages.NeedTypesSizes |
+	packages.NeedSyntax | packages.NeedTypesInfo
+
+// typedFile is a file loaded with the type information of its package
+type typedFile struct {
+	path string
+	pkg  *packages.Package
+	file *ast.File
+}
+
+// rewriteTyped rewrites the files with the type information of their packages.
+// The packages containing rewritten files are type checked again after the
+// rewriting, so the type errors of the rewritten code are reported before any
+// file is written. The files excluded by the build constraints are not loaded
+// and they are rewritten syntactically.
+func (r *Rewriter) rewriteTyped(files []string) error {
+	loaded, err := r.loadFiles()
+	if err != nil {
+		return err
+	}
+
+	var typed []typedFile
+	var untyped []string
+	var pkgs []*packages.Package
+	seen := map[*packages.Package]bool{}
+	for _, path := range files {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		tf, found := loaded[absPath]
+		if !found {
+			untyped = append(untyped, path)
+			continue
+		}
+		if len(tf.pkg.Errors) > 0 {
+			return packageErrors(tf.pkg)
+		}
+
+		if err := r.rewriteTypedFile(path, tf); err != nil {
+			return err
+		}
+		if !r.rewritten {
+			continue
+		}
+		tf.path = path
+		typed = append(typed, tf)
+		if !seen[tf.pkg] {
+			seen[tf.pkg] = true
+			pkgs = append(pkgs, tf.pkg)
+		}
+	}
+
+	for _, pkg := range pkgs {
+		if err := checkRewritten(pkg); err != nil {
+			return err
+		}
+	}
+	for _, tf := range typed {
+		src, err := os.ReadFile(tf.path)
+		if err != nil {
+			return err
+		}
+		r.info = tf.pkg.TypesInfo
+		err = r.writeFile(tf.path, tf.pkg.Fset, tf.file, src)
+		r.info = nil
+		if err != nil {
+			return err
+		}
+	}
+	for _, path := range untyped {
+		if err := r.RewriteFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteTypedFile rewrites the AST of a loaded file with the type information of its package
+func (r *Rewriter) rewriteTypedFile(path string, tf typedFile) error {
+	r.info = tf.pkg.TypesInfo
+	defer func() {
+		r.info = nil
+	}()
+	return r.rewriteFile(path, tf.pkg.Fset, tf.file)
+}
+
+// loadFiles loads the packages in the rewrite path, including the test files,
+// and returns the loaded files by their absolute paths.
+func (r *Rewriter) loadFiles() (map[string]typedFile, error) {
+	dir, pattern := r.rewriteDir, "./..."
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		dir, pattern = filepath.Dir(dir), "."
+	}
+	return loadPackages(dir, pattern, nil)
+}
+
+// loadPackages loads the packages matched by the pattern in the directory, the
+// contents of the files are replaced by the overlay which is indexed by the
+// absolute paths.
+func loadPackages(dir, pattern string, overlay map[string][]byte) (map[string]typedFile, error) {
+	cfg := &packages.Config{
+		Mode:    loadMode,
+		Dir:     dir,
+		Tests:   true,
+		Overlay: overlay,
+	}
+	pkgs, err := packages.Load(cfg, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	// The test variant of a package contains the same files as the package
+	// and its in-package test files, so it is preferred.
+	hasTestVariant := map[string]bool{}
+	for _, pkg := range pkgs {
+		if pkg.ID == testVariantID(pkg.PkgPath) {
+			hasTestVariant[pkg.PkgPath] = true
+		}
+	}
+	loaded := map[string]typedFile{}
+	for _, pkg := range pkgs {
+		if pkg.ID == pkg.PkgPath && hasTestVariant[pkg.PkgPath] {
+			continue
+		}
+		for _, file := range pkg.Syntax {
+			path := pkg.Fset.Position(file.Package).Filename
+			loaded[path] = typedFile{pkg: pkg, file: file}
+		}
+	}
+	return loaded, nil
+}
+
+// rewriteStashed rewrites the stashed original file in the type-aware mode and
+// writes the result to the output. The package is loaded with all the stashed
+// files in the directory in place of the rewritten ones, the loaded packages are
+// cached in the map by the directory.
+func (r *Rewriter) rewriteStashed(originPath string, originContent []byte, cache map[string]map[string]typedFile) error {
+	originPath, err := filepath.Abs(originPath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(originPath)
+	loaded, found := cache[dir]
+	if !found {
+		stashFiles, err := filepath.Glob(filepath.Join(dir, "*.go"+failpointStashFileSuffix))
+		if err != nil {
+			return err
+		}
+		overlay := map[string][]byte{}
+		for _, stashFile := range stashFiles {
+			content, err := os.ReadFile(stashFile)
+			if err != nil {
+				return err
+			}
+			overlay[strings.TrimSuffix(stashFile, failpointStashFileSuffix)] = content
+		}
+		if loaded, err = loadPackages(dir, ".", overlay); err != nil {
+			return err
+		}
+		cache[dir] = loaded
+	}
+
+	tf, found := loaded[originPath]
+	if !found {
+		return fmt.Errorf("%s is not loaded for restoring", originPath)
+	}
+	if err := r.rewriteTypedFile(originPath, tf); err != nil {
+		return err
+	}
+	if !r.rewritten {
+		return nil
+	}
+	r.info = tf.pkg.TypesInfo
+	defer func() {
+		r.info = nil
+	}()
+	return r.writeFile(originPath, tf.pkg.Fset, tf.file, originContent)
+}
+
+// testVariantID returns the ID of the package compiled with its in-package test files
+func testVariantID(pkgPath string) string {
+	return fmt.Sprintf("%s [%s.test]", pkgPath, pkgPath)
+}
+
+// checkRewritten type checks the rewritten files of the package. The binding
+// function is declared in a fake file if the binding file does not exist yet.
+func checkRewritten(pkg *packages.Package) error {
+	files := pkg.Syntax
+	if pkg.Types.Scope().Lookup(ExtendPkgName) == nil {
+		binding := fmt.Sprintf("package %s\n\nfunc %s(name string) string { return name }\n", pkg.Name, ExtendPkgName)
+		file, err := parser.ParseFile(pkg.Fset, failpointBindingFileName, binding, 0)
+		if err != nil {
+			return err
+		}
+		files = append(files[:len(files):len(files)], file)
+	}
+
+	// The rewritten code imports nothing new, the loaded imports are reused
+	var errs []string
+	conf := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			if imp, ok := pkg.Imports[path]; ok && imp.Types != nil {
+				return imp.Types, nil
+			}
+			return nil, fmt.Errorf("package %s is not loaded", path)
+		}),
+		Sizes: pkg.TypesSizes,
+		Error: func(err error) {
+			errs = append(errs, err.Error())
+		},
+	}
+	_, _ = conf.Check(pkg.PkgPath, pkg.Fset, files, nil)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "\n"))
+}
+
+func packageErrors(pkg *packages.Package) error {
+	errs := make([]string, 0, len(pkg.Errors))
+	for _, err := range pkg.Errors {
+		errs = append(errs, err.Error())
+	}
+	return errors.New(strings.Join(errs, "\n"))
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) {
+	return f(path)
+}
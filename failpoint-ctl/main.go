@@ -15,26 +15,62 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/pingcap/failpoint"
 	"github.com/pingcap/failpoint/code"
 	"github.com/pingcap/failpoint/failpoint-ctl/version"
 )
 
 func main() {
-	if len(os.Args) < 2 || (os.Args[1] != "enable" && os.Args[1] != "disable" && os.Args[1] != "-V") {
+	if len(os.Args) < 2 {
 		usage()
 	}
 
-	if os.Args[1] == "-V" {
+	switch os.Args[1] {
+	case "-V":
 		version.PrintVersion()
 		os.Exit(0)
+	case "enable":
+		enable(os.Args[2:])
+	case "disable":
+		disable(os.Args[2:])
+	case "generate":
+		generate(targetPaths(os.Args[2:]))
+	case "status":
+		paths, _ := targetPaths(os.Args[2:])
+		status(paths)
+	case "check-staged":
+		checkStaged(absPaths(os.Args[2:]))
+	case "cover-remap":
+		coverRemap(os.Args[2:])
+	default:
+		usage()
 	}
+}
 
-	// Use current work path if user does not specify any path
-	paths := os.Args[2:]
+func usage() {
+	fmt.Println("failpoint-ctl enable [--strict] [--typecheck] [--git] [--workers n] [--cache=false] [--include glob] [--exclude glob] [--dry-run | --diff | --overlay out.json [--overlay-dir dir]] /target/path [/target/path2 /target/path3 ...]")
+	fmt.Println("failpoint-ctl disable [--force] /target/path [/target/path2 /target/path3 ...]")
+	fmt.Println("failpoint-ctl generate [/target/path ...]")
+	fmt.Println("failpoint-ctl status [/target/path ...]")
+	fmt.Println("failpoint-ctl check-staged [/repository/path ...]")
+	fmt.Println("failpoint-ctl cover-remap [-i coverprofile] [-o output] [/target/path ...]")
+	fmt.Println("The target paths of enable, disable, generate and status can be Go package patterns, e.g. ./pkg/...")
+	os.Exit(1)
+}
+
+// absPaths expands all paths to its absolute path form, the current
+// work path is used if user does not specify any path
+func absPaths(paths []string) []string {
 	if len(paths) == 0 {
 		wd, err := os.Getwd()
 		if err != nil {
@@ -44,7 +80,6 @@ func main() {
 		paths = append(paths, wd)
 	}
 
-	// Expand all paths to its absolute path form
 	for i := range paths {
 		absPath, err := filepath.Abs(paths[i])
 		if err != nil {
@@ -58,34 +93,268 @@ func main() {
 		}
 		paths[i] = realPath
 	}
+	return paths
+}
 
-	switch os.Args[1] {
-	case "enable":
-		var rewritePath []string
-		var errOccurred bool
-		for _, path := range paths {
-			rewritePath = append(rewritePath, path)
-			rewriter := code.NewRewriter(path)
-			if err := rewriter.Rewrite(); err != nil {
-				fmt.Println("Rewrite error " + err.Error())
-				errOccurred = true
-				break
+// targetPaths resolves the Go package patterns in the arguments, e.g. `./pkg/...`,
+// to the directories of the packages by `go list`, and expands the other arguments
+// to the absolute paths. The directories of the packages are returned as well,
+// their subdirectories are not rewritten.
+func targetPaths(args []string) ([]string, map[string]bool) {
+	var paths, others []string
+	packageDirs := map[string]bool{}
+	for _, arg := range args {
+		if !code.IsPackagePattern(arg) {
+			others = append(others, arg)
+			continue
+		}
+		dirs, err := code.PackageDirs("", arg)
+		if err != nil {
+			fmt.Println("Package pattern error " + err.Error())
+			os.Exit(1)
+		}
+		if len(dirs) == 0 {
+			fmt.Println("Package pattern " + arg + " matched no packages")
+			os.Exit(1)
+		}
+		for _, dir := range absPaths(dirs) {
+			if !packageDirs[dir] {
+				packageDirs[dir] = true
+				paths = append(paths, dir)
 			}
 		}
-		// Restore all paths which have been rewrited if any error occurred
-		// to avoid partial rewrite state which maybe make user strange.
-		if errOccurred {
-			restoreFiles(rewritePath)
+	}
+	if len(others) > 0 || len(paths) == 0 {
+		paths = append(paths, absPaths(others)...)
+	}
+	return paths, packageDirs
+}
+
+// patternsFlag is a flag of the glob patterns, which can be repeated or separated by commas
+type patternsFlag []string
+
+func (p *patternsFlag) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternsFlag) Set(value string) error {
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			*p = append(*p, pattern)
+		}
+	}
+	return nil
+}
+
+func enable(args []string) {
+	flags := flag.NewFlagSet("enable", flag.ExitOnError)
+	strict := flags.Bool("strict", false, "report the unsupported statements and expressions as errors")
+	typeCheck := flags.Bool("typecheck", false, "resolve the markers with the type information of the packages")
+	dryRun := flags.Bool("dry-run", false, "list the files which would be rewritten without modifying them")
+	diff := flags.Bool("diff", false, "print the unified diffs of the files which would be rewritten without modifying them")
+	git := flags.Bool("git", false, "hide the rewritten and generated files from git until they are restored")
+	overlay := flags.String("overlay", "", "write the rewritten files out of the tree and the overlay file for go build to the path")
+	var include, exclude patternsFlag
+	flags.Var(&include, "include", "rewrite only the files matching the glob pattern, it can be repeated")
+	flags.Var(&exclude, "exclude", "do not rewrite the files or directories matching the glob pattern, it can be repeated")
+	cache := flags.Bool("cache", true, "reuse the files rewritten by the previous runs, which are cached in the user cache directory or $"+code.CacheDirEnv+" and removed after 5 days unused")
+	workers := flags.Int("workers", 0, "the number of the directories rewritten concurrently, default to GOMAXPROCS")
+	overlayDir := flags.String("overlay-dir", "", "the directory of the rewritten files, default to failpoint-overlay next to the overlay file")
+	_ = flags.Parse(args)
+
+	// The enabled files are skipped by the rewriter, but the conflicts are
+	// reported before any path is rewritten, otherwise the paths would be
+	// restored for the errors.
+	paths, packageDirs := targetPaths(flags.Args())
+	for _, path := range paths {
+		st, err := code.GetStatus(path)
+		if err != nil {
+			fmt.Println("Status error " + err.Error())
+			os.Exit(1)
+		}
+		if conflicts := st.Conflicts(); len(conflicts) > 0 {
+			fmt.Println(path + " has been partially enabled, run `failpoint-ctl disable` first:")
+			for _, file := range conflicts {
+				fmt.Println("  " + file)
+			}
 			os.Exit(1)
 		}
-	case "disable":
-		restoreFiles(paths)
+	}
+
+	var rewriteCache *code.Cache
+	if *cache {
+		dir, err := code.DefaultCacheDir()
+		if err != nil {
+			fmt.Println("Cache directory error " + err.Error())
+			os.Exit(1)
+		}
+		rewriteCache = code.NewCache(dir)
+		if err := rewriteCache.Trim(); err != nil {
+			fmt.Println("Trim cache error " + err.Error())
+		}
+	}
+	newRewriter := func(path string) *code.Rewriter {
+		rewriter := code.NewRewriter(path)
+		rewriter.SetLineDirectives(true)
+		rewriter.SetStrict(*strict)
+		rewriter.SetTypeCheck(*typeCheck)
+		rewriter.SetGit(*git)
+		rewriter.SetWorkers(*workers)
+		rewriter.SetCache(rewriteCache)
+		rewriter.SetInclude(include)
+		rewriter.SetExclude(exclude)
+		rewriter.SetRecursive(!packageDirs[path])
+		rewriter.SetLogger(failpoint.LoggerFunc(func(msg string, _ ...interface{}) {
+			fmt.Println(msg)
+		}))
+		return rewriter
+	}
+	if *dryRun || *diff {
+		previewRewrite(paths, newRewriter, *diff)
+		return
+	}
+	if *overlay != "" {
+		overlayRewrite(paths, newRewriter, *overlay, *overlayDir)
+		return
+	}
+
+	var rewritePath []string
+	var errOccurred bool
+	for _, path := range paths {
+		rewritePath = append(rewritePath, path)
+		rewriter := newRewriter(path)
+		if err := rewriter.Rewrite(); err != nil {
+			fmt.Println("Rewrite error " + err.Error())
+			errOccurred = true
+			break
+		}
+		printStats(path, rewriter.Stats())
+	}
+	// Restore all paths which have been rewrited if any error occurred
+	// to avoid partial rewrite state which maybe make user strange.
+	if errOccurred {
+		restoreFiles(rewritePath)
+		os.Exit(1)
 	}
 }
 
-func usage() {
-	fmt.Println("failpoint-ctl enable/disable /target/path [/target/path2 /target/path3 ...]")
-	os.Exit(1)
+// printStats prints the number of the rewritten files and the time spent on a path
+func printStats(path string, stats code.RewriteStats) {
+	fmt.Printf("%s: rewrote %d of %d files in %s\n", path, stats.Rewritten, stats.Scanned, stats.Elapsed.Round(time.Millisecond))
+}
+
+// overlayRewrite rewrites the paths to the overlay directory without modifying
+// them, and writes the overlay file for `go build -overlay`.
+func overlayRewrite(paths []string, newRewriter func(path string) *code.Rewriter, overlayPath, overlayDir string) {
+	overlayPath, err := filepath.Abs(overlayPath)
+	if err != nil {
+		fmt.Println("Error occurred in absolute path " + overlayPath + " with " + err.Error())
+		os.Exit(1)
+	}
+	if overlayDir == "" {
+		overlayDir = filepath.Join(filepath.Dir(overlayPath), "failpoint-overlay")
+	}
+	overlay := &code.Overlay{Replace: map[string]string{}}
+	for _, path := range paths {
+		rewriter := newRewriter(path)
+		rewriter.SetOverlay(overlayDir, overlay)
+		if err := rewriter.Rewrite(); err != nil {
+			fmt.Println("Rewrite error " + err.Error())
+			os.Exit(1)
+		}
+		printStats(path, rewriter.Stats())
+	}
+	if err := code.WriteOverlay(overlayPath, overlay); err != nil {
+		fmt.Println("Write overlay error " + err.Error())
+		os.Exit(1)
+	}
+}
+
+// previewRewrite rewrites the paths without modifying them, and prints the files
+// which would be rewritten or the unified diffs of them.
+func previewRewrite(paths []string, newRewriter func(path string) *code.Rewriter, diff bool) {
+	for _, path := range paths {
+		var files []string
+		outputs := map[string]*bytes.Buffer{}
+		rewriter := newRewriter(path)
+		rewriter.SetOutputFunc(func(file string) (io.Writer, error) {
+			files = append(files, file)
+			outputs[file] = &bytes.Buffer{}
+			return outputs[file], nil
+		})
+		if err := rewriter.Rewrite(); err != nil {
+			fmt.Println("Rewrite error " + err.Error())
+			os.Exit(1)
+		}
+
+		// The directories are rewritten concurrently
+		sort.Strings(files)
+		for _, file := range files {
+			if !diff {
+				fmt.Println(file)
+				continue
+			}
+			original, err := os.ReadFile(file)
+			if err != nil {
+				fmt.Println("Read file error " + err.Error())
+				os.Exit(1)
+			}
+			fmt.Print(code.UnifiedDiff(file, file, string(original), outputs[file].String(), 3))
+		}
+	}
+}
+
+// generate generates the failpoint variants of the source files under the paths,
+// which are built with `-tags failpoint` and the overlay file written to the module
+// root instead of rewriting the source files.
+func generate(paths []string, packageDirs map[string]bool) {
+	for _, path := range paths {
+		generator := code.NewGenerator(path)
+		generator.SetRecursive(!packageDirs[path])
+		if err := generator.Generate(); err != nil {
+			fmt.Println("Generate error " + err.Error())
+			os.Exit(1)
+		}
+		for _, file := range generator.Generated() {
+			fmt.Println("generated: " + file)
+		}
+		for _, file := range generator.Removed() {
+			fmt.Println("removed: " + file)
+		}
+	}
+}
+
+// disable restores the paths and prints the summary of the restored files. No
+// file of a path is restored if any of them conflicts, unless --force is set.
+func disable(args []string) {
+	flags := flag.NewFlagSet("disable", flag.ExitOnError)
+	force := flags.Bool("force", false, "restore the conflicted files with the modifications which can be merged back")
+	_ = flags.Parse(args)
+
+	var errOccurred bool
+	paths, _ := targetPaths(flags.Args())
+	for _, path := range paths {
+		restorer := code.NewRestorer(path)
+		restorer.SetForce(*force)
+		err := restorer.Restore()
+		for _, result := range restorer.Results() {
+			switch {
+			case err != nil && result.State != code.RestoreConflicted:
+				continue
+			case result.Rejects != "":
+				fmt.Printf("%s: %s, the rejected hunks are written to %s\n", result.State, result.Path, result.Rejects)
+			default:
+				fmt.Printf("%s: %s\n", result.State, result.Path)
+			}
+		}
+		if err != nil {
+			fmt.Println("Restore error " + err.Error())
+			errOccurred = true
+		}
+	}
+	if errOccurred {
+		os.Exit(1)
+	}
 }
 
 func restoreFiles(paths []string) {
@@ -97,3 +366,85 @@ func restoreFiles(paths []string) {
 		}
 	}
 }
+
+// status prints whether the paths are enabled, partially enabled or clean, and
+// the files which make a path partially enabled.
+func status(paths []string) {
+	for _, path := range paths {
+		st, err := code.GetStatus(path)
+		if err != nil {
+			fmt.Println("Status error " + err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("%s: %s\n", path, st.State)
+		if st.State == code.StateClean {
+			continue
+		}
+		for _, file := range st.Pending {
+			fmt.Println("  pending: " + file)
+		}
+		for _, file := range st.Orphans {
+			fmt.Println("  orphan: " + file)
+		}
+	}
+}
+
+// checkStaged fails if the files generated or rewritten by `failpoint-ctl enable`
+// are staged in the git repositories, it is used by the git pre-commit hooks.
+func checkStaged(paths []string) {
+	var staged []string
+	for _, path := range paths {
+		files, err := code.StagedFailpointFiles(path)
+		if err != nil {
+			fmt.Println("Check staged files error " + err.Error())
+			os.Exit(1)
+		}
+		for _, file := range files {
+			staged = append(staged, filepath.Join(path, file))
+		}
+	}
+	if len(staged) == 0 {
+		return
+	}
+	fmt.Println("The failpoint rewritten files are staged, run `failpoint-ctl disable` and stage them again:")
+	for _, file := range staged {
+		fmt.Println("  " + file)
+	}
+	os.Exit(1)
+}
+
+// coverRemap translates the coverage profile of the rewritten files back to the
+// original files, it must run before `failpoint-ctl disable` removes the line maps.
+func coverRemap(args []string) {
+	flags := flag.NewFlagSet("cover-remap", flag.ExitOnError)
+	input := flags.String("i", "", "the coverage profile to remap, default to stdin")
+	output := flags.String("o", "", "the remapped coverage profile, default to stdout")
+	_ = flags.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Open coverage profile error "+err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Create coverage profile error "+err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	remapper := code.NewCoverRemapper(absPaths(flags.Args())...)
+	if err := remapper.Remap(in, out); err != nil {
+		fmt.Fprintln(os.Stderr, "Remap coverage profile error "+err.Error())
+		os.Exit(1)
+	}
+}
@@ -16,14 +16,19 @@ package main
 
 import (
 	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/pingcap/errors"
+	"github.com/pingcap/failpoint"
 	"github.com/pingcap/failpoint/code"
 	"golang.org/x/mod/modfile"
 )
@@ -42,6 +47,12 @@ func main() {
 
 	if strings.ToLower(goCmdBase) == "compile" {
 		if err := injectFailpoint(&buildArgs); err != nil {
+			if isStrict() {
+				// The failpoints of the package would be silently inactive
+				fmt.Fprintf(os.Stderr, "failpoint-toolexec: %v\n", err)
+				fmt.Fprintf(os.Stderr, "failpoint-toolexec: set %s=false to compile the original files instead\n", strictEnv)
+				os.Exit(1)
+			}
 			logger.Println("failed to inject failpoint", err)
 		}
 	}
@@ -51,15 +62,44 @@ func main() {
 	cmd.Stderr = os.Stderr
 
 	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			// The tool has reported its errors, so only its exit status is propagated
+			if exitCode := exitErr.ExitCode(); exitCode > 0 {
+				os.Exit(exitCode)
+			}
+		}
 		logger.Println("failed to run command", err)
+		os.Exit(1)
 	}
 }
 
+// strictEnv is the environment variable of the strict mode, which is on by default.
+// In the strict mode, the compilation is aborted if any file of the package fails
+// to be rewritten, otherwise the original files are compiled.
+const strictEnv = "FAILPOINT_TOOLEXEC_STRICT"
+
+func isStrict() bool {
+	strict, err := strconv.ParseBool(os.Getenv(strictEnv))
+	return err != nil || strict
+}
+
 func injectFailpoint(argsP *[]string) error {
 	callersModule, err := findCallersModule()
 	if err != nil {
 		return err
 	}
+	if callersModule == "" {
+		// The dependencies may have no go.mod, but the failpoints of the other
+		// packages would be silently inactive
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if isStrict() && !inSDKOrMod(cwd) {
+			return errors.Errorf("failed to find go.mod of the package in %s", cwd)
+		}
+		return nil
+	}
 
 	// ref https://pkg.go.dev/cmd/compile#hdr-Command_Line
 	var module string
@@ -84,15 +124,45 @@ func injectFailpoint(argsP *[]string) error {
 		}
 	}
 
-	needExtraFile := false
+	cacheDir, err := code.DefaultCacheDir()
+	if err != nil {
+		return err
+	}
+	cache := code.NewCache(cacheDir)
+	if err := cache.Trim(); err != nil {
+		logger.Println("failed to trim the cache", err)
+	}
 	writer := &code.Rewriter{}
 	writer.SetAllowNotChecked(true)
+	writer.SetLineDirectives(true)
+	writer.SetCache(cache)
+	writer.SetLogger(failpoint.LoggerFunc(func(msg string, _ ...interface{}) {
+		logger.Println(msg)
+	}))
+	var rewrittenFile string
+	var errs []string
 	for _, idx := range fileIndices {
-		needExtraFile = injectFailpointForFile(writer, &args[idx], module) || needExtraFile
+		file := args[idx]
+		rewritten, err := injectFailpointForFile(writer, &args[idx], cacheDir, module)
+		if err != nil {
+			// The error of the rewriter refers to the offending line
+			errs = append(errs, fmt.Sprintf("failed to rewrite %s: %v", file, err))
+			continue
+		}
+		if rewritten {
+			rewrittenFile = file
+		}
 	}
-	if needExtraFile {
-		newFile := filepath.Join(tmpFolder, module, "failpoint_toolexec_extra.go")
-		if err := writeExtraFile(newFile, writer.GetCurrentFile().Name.Name, module); err != nil {
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	if rewrittenFile != "" {
+		pkg, err := parser.ParseFile(token.NewFileSet(), rewrittenFile, nil, parser.PackageClauseOnly)
+		if err != nil {
+			return err
+		}
+		newFile := filepath.Join(toolexecDir(cacheDir), module, "failpoint_toolexec_extra.go")
+		if err := writeExtraFile(newFile, pkg.Name.Name, module); err != nil {
 			return err
 		}
 		*argsP = append(args, newFile)
@@ -128,12 +198,24 @@ func findCallersModule() (string, error) {
 		}
 		dir = d
 	}
-	return "", errors.New("go.mod file not found")
+	return "", nil
 }
 
-var goModCache = os.Getenv("GOMODCACHE")
+var goModCache = defaultGoModCache()
 var goRoot = runtime.GOROOT()
 
+// defaultGoModCache returns the module cache, which is in the first GOPATH if
+// GOMODCACHE is not set, see `go help environment`
+func defaultGoModCache() string {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir
+	}
+	if list := filepath.SplitList(build.Default.GOPATH); len(list) > 0 && list[0] != "" {
+		return filepath.Join(list[0], "pkg", "mod")
+	}
+	return ""
+}
+
 func inSDKOrMod(path string) bool {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
@@ -150,32 +232,47 @@ func inSDKOrMod(path string) bool {
 	return false
 }
 
-var tmpFolder = filepath.Join(os.TempDir(), "failpoint-toolexec")
+// toolexecDir is the directory of the line maps and the extra files in the cache,
+// which are indexed by the packages. The rewritten files are compiled in the cache.
+func toolexecDir(cacheDir string) string {
+	return filepath.Join(cacheDir, "toolexec")
+}
 
-func injectFailpointForFile(w *code.Rewriter, file *string, module string) bool {
-	newFile := filepath.Join(tmpFolder, module, filepath.Base(*file))
-	newFileDir := filepath.Dir(newFile)
-	if err := os.MkdirAll(newFileDir, 0700); err != nil {
-		logger.Println("failed to create temp folder", err)
-		return false
-	}
-	f, err := os.OpenFile(newFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+// injectFailpointForFile rewrites the file and replaces it by the rewritten one
+// in the cache, it returns whether the file has been rewritten
+func injectFailpointForFile(w *code.Rewriter, file *string, cacheDir, module string) (bool, error) {
+	newFile, err := w.RewriteFileToCache(*file)
 	if err != nil {
-		logger.Println("failed to open temp file", err)
-		return false
+		return false, err
 	}
-	defer f.Close()
-	w.SetOutput(f)
-
-	if err := w.RewriteFile(*file); err != nil {
-		logger.Println("failed to rewrite file", err)
-		return false
+	if newFile == "" {
+		return false, nil
 	}
-	if !w.GetRewritten() {
-		return false
+	if err := writeLineMap(w.GetLineMap(), *file, cacheDir, module); err != nil {
+		logger.Println("failed to write line map", err)
 	}
 	*file = newFile
-	return true
+	return true, nil
+}
+
+// writeLineMap records the line map of the file to remap the coverage profile,
+// the line maps are indexed by the packages in the sidecar directory of the cache.
+// The files generated by a tool are skipped, e.g. the files instrumented by
+// `go test -cover` from the original files, their coverage counters refer to
+// the original lines already and must not be remapped again.
+func writeLineMap(m *code.LineMap, file, cacheDir, module string) error {
+	if m == nil {
+		return nil
+	}
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	if m.Original != absFile {
+		return nil
+	}
+	root := toolexecDir(cacheDir)
+	return code.WriteLineMap(root, filepath.Join(root, module, filepath.Base(file)), m)
 }
 
 func writeExtraFile(filePath, packageName, module string) error {
@@ -186,5 +283,26 @@ func %s(name string) string {
 	return "%s/" + name
 }
 `, packageName, code.ExtendPkgName, module)
-	return os.WriteFile(filePath, []byte(bindingContent), 0644)
+	if content, err := os.ReadFile(filePath); err == nil && string(content) == bindingContent {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	// The file may be read by another compiler of the package concurrently, e.g.
+	// the one of its test variant
+	f, err := os.CreateTemp(filepath.Dir(filePath), "failpoint_toolexec_extra.tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(bindingContent); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filePath)
 }
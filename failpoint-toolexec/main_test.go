@@ -0,0 +1,124 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/failpoint/code"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoverProfile(t *testing.T) {
+	// The package must be in the module to be rewritten
+	pkgDir, err := filepath.Abs("../tmp/toolexec-cover")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(pkgDir))
+	}()
+	require.NoError(t, os.MkdirAll(pkgDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(pkgDir, "cover.go"), []byte(`package cover
+
+import (
+	"fmt"
+
+	"github.com/pingcap/failpoint"
+)
+
+func Cover() {
+	failpoint.Inject("cover", func(
+		val failpoint.Value,
+	) {
+		fmt.Println("cover", val)
+	})
+	fmt.Println("after")
+}
+`), 0644))
+	tempDir := t.TempDir()
+	// The test file is unique, so the package is always compiled by failpoint-toolexec
+	// instead of being reused from the build cache
+	require.NoError(t, os.WriteFile(filepath.Join(pkgDir, "cover_test.go"), []byte(`package cover
+
+import "testing"
+
+func TestCover(t *testing.T) {
+	Cover()
+}
+
+const testDir = `+strconv.Quote(tempDir)+`
+`), 0644))
+
+	toolexec := filepath.Join(tempDir, "failpoint-toolexec")
+	out, err := exec.Command("go", "build", "-o", toolexec, ".").CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	cacheDir := filepath.Join(tempDir, "cache")
+	profile := filepath.Join(tempDir, "cover.out")
+	cmd := exec.Command("go", "test", "-v", "-count=1", "-toolexec", toolexec, "-coverprofile", profile, ".")
+	cmd.Dir = pkgDir
+	cmd.Env = append(os.Environ(),
+		code.CacheDirEnv+"="+cacheDir,
+		`GO_FAILPOINTS=github.com/pingcap/failpoint/tmp/toolexec-cover/cover=return("on")`,
+	)
+	out, err = cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	// The failpoint is injected into the instrumented file
+	require.Contains(t, string(out), "cover on")
+
+	content, err := os.ReadFile(profile)
+	require.NoError(t, err)
+	// The counters of `go test -cover` refer to the original lines
+	after := fmt.Sprintf("github.com/pingcap/failpoint/tmp/toolexec-cover/cover.go:%d.", 15)
+	require.Contains(t, string(content), "\n"+after)
+
+	// The profile is not remapped again by the line maps of failpoint-toolexec,
+	// which are not recorded for the instrumented files
+	lineMaps, err := filepath.Glob(filepath.Join(toolexecDir(cacheDir), "__failpoint_linemaps__", "*"))
+	require.NoError(t, err)
+	require.Empty(t, lineMaps)
+	remapped := &bytes.Buffer{}
+	require.NoError(t, code.NewCoverRemapper(toolexecDir(cacheDir)).Remap(bytes.NewReader(content), remapped))
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.Contains(line, "cover.go:") {
+			require.Contains(t, remapped.String(), line+"\n")
+		}
+	}
+}
+
+func TestInjectFailpointWithoutGoMod(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	tempDir := t.TempDir()
+	require.NoError(t, os.Chdir(tempDir))
+	defer func() {
+		require.NoError(t, os.Chdir(wd))
+	}()
+
+	// The package without go.mod is reported in the strict mode
+	args := []string{"-p", "main", filepath.Join(tempDir, "main.go")}
+	t.Setenv(strictEnv, "true")
+	err = injectFailpoint(&args)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to find go.mod of the package")
+	t.Setenv(strictEnv, "false")
+	require.NoError(t, injectFailpoint(&args))
+}
@@ -32,6 +32,9 @@ type (
 	// 1. val.(int)      // GO_FAILPOINTS="failpoint-name=return(1)"
 	// 2. val.(string)   // GO_FAILPOINTS="failpoint-name=return(\"1\")"
 	// 3. val.(bool)     // GO_FAILPOINTS="failpoint-name=return(true)"
+	// 4. val.(float64)  // GO_FAILPOINTS="failpoint-name=return(1.5)"
+	// The closure of Inject can also take the typed parameter instead,
+	// e.g. `func(n int)`, see EvalAs for the conversions.
 	Value interface{}
 
 	// Hook is used to filter failpoint, if the hook returns false and the
@@ -40,6 +43,9 @@ type (
 
 	// Failpoint is a point to inject a failure
 	Failpoint struct {
+		// name is the failpath which the failpoint registered with, it is
+		// only used to describe the failpoint in log messages.
+		name     string
 		mu       sync.RWMutex
 		t        *terms
 		waitChan chan struct{}
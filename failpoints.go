@@ -55,8 +55,13 @@ var (
 	ErrFiltered FpError = fmt.Errorf("failpoint: filtered by hook")
 	// ErrNotAllowed represents a failpoint can not be executed this time
 	ErrNotAllowed FpError = fmt.Errorf("failpoint: not allowed")
+	// ErrValueType represents the value of a failpoint can not be converted to
+	// the parameter type of the failpoint closure
+	ErrValueType FpError = fmt.Errorf("failpoint: value type mismatch")
 )
 
+// init enables the failpoints of GO_FAILPOINTS and serves GO_FAILPOINTS_HTTP. Their
+// errors are fatal and written to stderr directly, as no logger can be set before.
 func init() {
 	failpoints.reg = make(map[string]*Failpoint)
 	if s := os.Getenv("GO_FAILPOINTS"); len(s) > 0 {
@@ -64,19 +69,19 @@ func init() {
 		for _, fp := range strings.Split(s, ";") {
 			fpTerms := strings.Split(fp, "=")
 			if len(fpTerms) != 2 {
-				fmt.Printf("bad failpoint %q\n", fp)
+				fmt.Fprintf(os.Stderr, "bad failpoint %q\n", fp)
 				os.Exit(1)
 			}
-			err := Enable(fpTerms[0], fpTerms[1])
+			err := enableEnv(fpTerms[0], fpTerms[1])
 			if err != nil {
-				fmt.Printf("bad failpoint %s\n", err)
+				fmt.Fprintf(os.Stderr, "bad failpoint %s\n", err)
 				os.Exit(1)
 			}
 		}
 	}
 	if s := os.Getenv("GO_FAILPOINTS_HTTP"); len(s) > 0 {
 		if err := serve(s); err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	}
@@ -99,7 +104,7 @@ func (fps *Failpoints) Enable(failpath, inTerms string) error {
 
 	fp := fps.reg[failpath]
 	if fp == nil {
-		fp = &Failpoint{}
+		fp = &Failpoint{name: failpath}
 		fps.reg[failpath] = fp
 	}
 	err := fp.Enable(inTerms)
@@ -123,7 +128,7 @@ func (fps *Failpoints) EnableWith(failpath, inTerms string, action func() error)
 
 	fp := fps.reg[failpath]
 	if fp == nil {
-		fp = &Failpoint{}
+		fp = &Failpoint{name: failpath}
 		fps.reg[failpath] = fp
 	}
 	err := fp.EnableWith(inTerms, action)
@@ -144,7 +149,7 @@ func (fps *Failpoints) EnableCall(failpath string, fn any) error {
 
 	fp := fps.reg[failpath]
 	if fp == nil {
-		fp = &Failpoint{}
+		fp = &Failpoint{name: failpath}
 		fps.reg[failpath] = fp
 	}
 	err := fp.EnableCall(fn)
@@ -181,7 +186,7 @@ func (fps *Failpoints) Status(failpath string) (string, error) {
 	if t == nil {
 		return "", errors.Wrapf(ErrDisabled, "error on %s", failpath)
 	}
-	return t.desc, nil
+	return t.String(), nil
 }
 
 // List returns all the failpoints information
@@ -298,9 +303,9 @@ func EvalContext(ctx context.Context, failpath string) (Value, error) {
 	val, err := failpoints.EvalContext(ctx, failpath)
 	// The package level EvalContext usaully be injected into the users
 	// code, in which case the error can not be handled by the generated
-	// code. We print the error here.
+	// code. We log the error here.
 	if err, ok := errors.Cause(err).(FpError); !ok && err != nil {
-		fmt.Println(err)
+		logMsg(err.Error(), "failpoint", failpath, "error", err)
 	}
 	return val, err
 }
@@ -310,7 +315,7 @@ func EvalContext(ctx context.Context, failpath string) (Value, error) {
 func Eval(failpath string) (Value, error) {
 	val, err := failpoints.Eval(failpath)
 	if err, ok := errors.Cause(err).(FpError); !ok && err != nil {
-		fmt.Println(err)
+		logMsg(err.Error(), "failpoint", failpath, "error", err)
 	}
 	return val, err
 }
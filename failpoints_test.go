@@ -17,6 +17,7 @@ package failpoint_test
 import (
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"testing"
 	"time"
 
@@ -58,6 +59,20 @@ func TestFailpoints(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "return(1)", status)
 
+	// The status is the terms as they are enabled
+	err = fps.Enable("failpoints-test-1", "50.0%2*return( 007 ) -> {1:off, 2.5:sleep(\"1ms\")}")
+	require.NoError(t, err)
+	status, err = fps.Status("failpoints-test-1")
+	require.NoError(t, err)
+	require.Equal(t, "50.0%2*return( 007 ) -> {1:off, 2.5:sleep(\"1ms\")}", status)
+
+	// The trailing arrow is allowed
+	for _, desc := range []string{"return(1)->", "off->"} {
+		require.NoError(t, fps.Enable("failpoints-test-1", desc))
+	}
+	err = fps.Enable("failpoints-test-1", "return(1)")
+	require.NoError(t, err)
+
 	err = fps.Enable("failpoints-test-3", "return(2)")
 	require.NoError(t, err)
 
@@ -240,3 +255,25 @@ func TestCall(t *testing.T) {
 	failpoint.Call("test", 123)
 	require.Equal(t, 123, capturedArg)
 }
+
+func TestEnvRegisteredAction(t *testing.T) {
+	if os.Getenv("FAILPOINT_TEST_ENV_ACTION") != "" {
+		// GO_FAILPOINTS is parsed before the action is registered
+		err := failpoint.RegisterAction("dropconn", func(failpoint.ActionContext) (failpoint.Value, error) {
+			return "dropped", nil
+		})
+		require.NoError(t, err)
+		val, err := failpoint.Eval("env-action")
+		require.NoError(t, err)
+		require.Equal(t, "dropped", val)
+		val, _ = failpoint.Eval("env-action")
+		require.Nil(t, val)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestEnvRegisteredAction$")
+	cmd.Env = append(os.Environ(), "FAILPOINT_TEST_ENV_ACTION=1", "GO_FAILPOINTS=env-action=1*dropconn()->off")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	require.Contains(t, string(out), "PASS")
+}
@@ -5,14 +5,16 @@ require (
 	github.com/sergi/go-diff v1.1.0
 	github.com/stretchr/testify v1.8.0
 	go.uber.org/goleak v1.3.0
-	golang.org/x/mod v0.17.0
+	golang.org/x/mod v0.20.0
+	golang.org/x/tools v0.24.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
-go 1.18
+go 1.19
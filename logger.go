@@ -0,0 +1,70 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failpoint
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Logger receives all messages generated by the failpoint library, e.g. the
+// output of the `print` action or errors raised while evaluating a failpoint.
+// The keyvals are alternating key/value pairs (the same convention as
+// `log/slog`) which describe the failpoint, e.g. "failpoint", "action" and "value".
+type Logger interface {
+	Log(msg string, keyvals ...interface{})
+}
+
+// LoggerFunc is an adapter to allow the use of ordinary functions as Logger.
+type LoggerFunc func(msg string, keyvals ...interface{})
+
+// Log calls f(msg, keyvals...).
+func (f LoggerFunc) Log(msg string, keyvals ...interface{}) {
+	f(msg, keyvals...)
+}
+
+// stdoutLogger is the default logger which prints the message to stdout
+// and drops the structured attributes.
+type stdoutLogger struct{}
+
+func (stdoutLogger) Log(msg string, _ ...interface{}) {
+	fmt.Println(msg)
+}
+
+var (
+	loggerMu sync.RWMutex
+	logger   Logger = stdoutLogger{}
+)
+
+// SetLogger replaces the logger used for all library-generated messages.
+// Passing nil restores the default logger which prints to stdout. The fatal
+// errors of GO_FAILPOINTS and GO_FAILPOINTS_HTTP are reported when the package
+// is initialized, before SetLogger can be called, so they are always written
+// to stderr.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = stdoutLogger{}
+	}
+	loggerMu.Lock()
+	logger = l
+	loggerMu.Unlock()
+}
+
+func logMsg(msg string, keyvals ...interface{}) {
+	loggerMu.RLock()
+	l := logger
+	loggerMu.RUnlock()
+	l.Log(msg, keyvals...)
+}
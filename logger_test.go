@@ -0,0 +1,63 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failpoint_test
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/pingcap/failpoint"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetLogger(t *testing.T) {
+	var (
+		msgs    []string
+		keyvals [][]interface{}
+	)
+	failpoint.SetLogger(failpoint.LoggerFunc(func(msg string, kvs ...interface{}) {
+		msgs = append(msgs, msg)
+		keyvals = append(keyvals, kvs)
+	}))
+	defer failpoint.SetLogger(nil)
+
+	require.NoError(t, failpoint.Enable("test-logger-print", `print("hello")`))
+	defer func() {
+		require.NoError(t, failpoint.Disable("test-logger-print"))
+	}()
+	val, err := failpoint.Eval("test-logger-print")
+	require.NoError(t, err)
+	require.Nil(t, val)
+	require.Equal(t, []string{"failpoint print: hello"}, msgs)
+	require.Equal(t, []interface{}{"failpoint", "test-logger-print", "action", "print", "value", "hello"}, keyvals[0])
+
+	// Disabled failpoints are not reported
+	_, err = failpoint.Eval("test-logger-not-exists")
+	require.Error(t, err)
+	require.Len(t, msgs, 1)
+}
+
+func TestInitErrorsToStderr(t *testing.T) {
+	// The bad GO_FAILPOINTS fails the initialization before any test runs
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "GO_FAILPOINTS=bad-init-failpoint")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	require.Error(t, cmd.Run())
+	require.Empty(t, stdout.String())
+	require.Equal(t, "bad failpoint \"bad-init-failpoint\"\n", stderr.String())
+}
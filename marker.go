@@ -14,24 +14,32 @@
 
 package failpoint
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // Inject marks a fail point routine, which will be rewrite to a `if` statement
 // and be triggered by fail point name specified `fpname`
-// Note: The fail point closure  parameter type can only be `failpoint.Value`
+// Note: The fail point closure parameter type can be `failpoint.Value` or any
+// other type, the value is converted by EvalAs and the closure is skipped if the
+// value can not be converted
 // e.g:
 // failpoint.Inject("fail-point-name", func() (...){}
 // failpoint.Inject("fail-point-name", func(val failpoint.Value) (...){}
 // failpoint.Inject("fail-point-name", func(_ failpoint.Value) (...){}
+// failpoint.Inject("fail-point-name", func(n int) (...){}
 func Inject(fpname string, fpbody interface{}) {}
 
 // InjectContext marks a fail point routine, which will be rewrite to a `if` statement
 // and be triggered by fail point name specified `fpname`
-// Note: The fail point closure  parameter type can only be `failpoint.Value`
+// Note: The fail point closure parameter type can be `failpoint.Value` or any
+// other type, the same as Inject
 // e.g:
 // failpoint.InjectContext(ctx, "fail-point-name", func() (...){}
 // failpoint.InjectContext(ctx, "fail-point-name", func(val failpoint.Value) (...){}
 // failpoint.InjectContext(ctx, "fail-point-name", func(_ failpoint.Value) (...){}
+// failpoint.InjectContext(ctx, "fail-point-name", func(d time.Duration) (...){}
 func InjectContext(ctx context.Context, fpname string, fpbody interface{}) {}
 
 // InjectCall marks a fail point routine, which will be rewrite to a `if` statement
@@ -40,6 +48,38 @@ func InjectContext(ctx context.Context, fpname string, fpbody interface{}) {}
 // as the InjectCall, otherwise it's a noop.
 func InjectCall(fpname string, args ...any) {}
 
+// Override marks a value which can be overridden by the fail point name specified
+// `fpname`, it will be rewrite to a call of EvalOverride which returns the value of
+// the fail point if it is enabled, otherwise the `val`, e.g:
+//
+//	n := failpoint.Override("fail-point-name", computeN())
+//
+// The value of the fail point is converted to the type of `val` by EvalAs.
+func Override[T any](fpname string, val T) T { return val }
+
+// Case marks the channel of a select case which will be chosen if the fail point
+// name specified `fpname` is enabled, the channels of the other cases are replaced
+// by nil, e.g:
+//
+//	select {
+//	case v := <-ch:
+//	case <-failpoint.Case("fail-point-name", time.After(timeout)):
+//	}
+//
+// The received value is the value of the fail point converted to the element type
+// of the channel, or the zero value if the fail point has no value. Only one case
+// of a select can be marked, and the marked select can not be a `goto` target.
+func Case[C any](fpname string, ch C) C { return ch }
+
+// After marks a synthetic select case which is never chosen unless the fail point
+// name specified `fpname` is enabled, it is chosen the same as Case, e.g:
+//
+//	select {
+//	case v := <-ch:
+//	case <-failpoint.After("fail-point-name"):
+//	}
+func After(fpname string) <-chan time.Time { return nil }
+
 // Break will generate a break statement in a loop, e.g:
 // case1:
 //
@@ -0,0 +1,94 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failpoint
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Selection is the evaluated failpoint of a select statement which has a case
+// marked by `failpoint.Case` or `failpoint.After`.
+type Selection struct {
+	failpath string
+	val      Value
+	enabled  bool
+}
+
+// EvalSelect evaluates the failpoint of a select statement, it is injected
+// before the select statement and the result is passed to SelectCase,
+// SelectOther and SelectAfter.
+func EvalSelect(failpath string) Selection {
+	val, err := Eval(failpath)
+	return Selection{failpath: failpath, val: val, enabled: err == nil}
+}
+
+// SelectCase returns the channel of the marked case. If the failpoint is
+// enabled, a ready channel is returned instead, which has a buffered value for
+// receiving and room for sending. The received value is the value of the
+// failpoint converted to the element type, or the zero value if the failpoint
+// has no value or the value can not be converted.
+func SelectCase[C any](s Selection, ch C) C {
+	if !s.enabled {
+		return ch
+	}
+	typ := reflect.TypeOf(&ch).Elem()
+	if typ.Kind() != reflect.Chan {
+		return ch
+	}
+	ready := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, typ.Elem()), 2)
+	ready.Send(s.value(typ.Elem()))
+	var out C
+	reflect.ValueOf(&out).Elem().Set(ready.Convert(typ))
+	return out
+}
+
+// SelectOther returns the channel of an unmarked case, it is nil if the
+// failpoint is enabled so that the case is never chosen.
+func SelectOther[C any](s Selection, ch C) C {
+	if s.enabled {
+		var none C
+		return none
+	}
+	return ch
+}
+
+// SelectAfter returns the channel of the synthetic case marked by
+// `failpoint.After`, it is nil if the failpoint is not enabled, otherwise
+// it is ready to receive the current time.
+func SelectAfter(s Selection) <-chan time.Time {
+	if !s.enabled {
+		return nil
+	}
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
+
+func (s Selection) value(typ reflect.Type) reflect.Value {
+	// The actions without argument evaluate to struct{}{}
+	if s.val == nil || s.val == (struct{}{}) {
+		return reflect.Zero(typ)
+	}
+	if v := reflect.ValueOf(s.val); v.Type().AssignableTo(typ) {
+		return v
+	}
+	if converted, ok := convertReflect(s.val, typ); ok {
+		return converted
+	}
+	logMsg(fmt.Sprintf("failpoint %s: can not use %#v as %s", s.failpath, s.val, typ), "failpoint", s.failpath, "value", s.val)
+	return reflect.Zero(typ)
+}
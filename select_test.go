@@ -0,0 +1,86 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failpoint_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pingcap/failpoint"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelect(t *testing.T) {
+	ready := make(chan int, 1)
+	sel := func(out chan<- int) (int, string) {
+		ready <- 1
+		defer func() {
+			// Drain the channel for the next selection
+			select {
+			case <-ready:
+			default:
+			}
+		}()
+		s := failpoint.EvalSelect("test-select")
+		select {
+		case v := <-failpoint.SelectOther(s, (<-chan int)(ready)):
+			return v, "ready"
+		case failpoint.SelectOther(s, out) <- 1:
+			return 0, "out"
+		case v := <-failpoint.SelectCase(s, time.After(time.Hour)):
+			return v.Second(), "timeout"
+		case <-failpoint.SelectAfter(s):
+			return 0, "after"
+		}
+	}
+
+	v, which := sel(nil)
+	require.Equal(t, 1, v)
+	require.Equal(t, "ready", which)
+
+	require.NoError(t, failpoint.Enable("test-select", "return"))
+	defer func() {
+		require.NoError(t, failpoint.Disable("test-select"))
+	}()
+	for i := 0; i < 10; i++ {
+		_, which = sel(make(chan int, 1))
+		require.Contains(t, []string{"timeout", "after"}, which)
+	}
+
+	ch := make(chan mode)
+	s := failpoint.EvalSelect("test-select")
+	select {
+	case m, ok := <-failpoint.SelectCase(s, ch):
+		require.True(t, ok)
+		require.Equal(t, mode(""), m)
+	case <-ch:
+		t.Fatal("unexpected case")
+	}
+
+	require.NoError(t, failpoint.Enable("test-select", `return("fast")`))
+	s = failpoint.EvalSelect("test-select")
+	select {
+	case m := <-failpoint.SelectCase(s, ch):
+		require.Equal(t, mode("fast"), m)
+	case <-failpoint.SelectOther(s, ch):
+		t.Fatal("unexpected case")
+	}
+	s = failpoint.EvalSelect("test-select")
+	select {
+	case failpoint.SelectCase(s, (chan<- mode)(ch)) <- "sent":
+	case <-failpoint.SelectOther(s, ch):
+		t.Fatal("unexpected case")
+	}
+}
@@ -33,9 +33,10 @@ import (
 	"math/rand"
 	"os"
 	"os/exec"
-	"strings"
 	"sync"
 	"time"
+
+	"github.com/pingcap/errors"
 )
 
 func init() {
@@ -44,8 +45,9 @@ func init() {
 
 // terms encodes the state for a failpoint term string (see fail(9) for examples)
 // <fp> :: <term> ( "->" <term> )*
+// A term can be a nested chain, see terms_parser.go for the full grammar.
 type terms struct {
-	// chain is a slice of all the terms from desc
+	// chain is a slice of all the terms compiled from ast
 	chain []*term
 	// desc is the full term given for the failpoint
 	desc string
@@ -60,16 +62,28 @@ type term struct {
 	mods mod
 	act  actFunc
 	val  interface{}
+	// body is set for the terms which run a nested expression
+	// (group, loop, choice or a sequence of actions) instead of an action
+	body expr
 
 	parent *terms
 	fp     *Failpoint
 }
 
+// expr is a nested expression of a term
+type expr interface {
+	// eval returns ErrNotAllowed if no term of the expression is allowed
+	eval() (Value, error)
+	// reset restores the initial state of the expression
+	reset()
+}
+
 type mod interface {
 	allow() bool
+	reset()
 }
 
-type modCount struct{ c int }
+type modCount struct{ n, c int }
 
 func (mc *modCount) allow() bool {
 	if mc.c > 0 {
@@ -79,10 +93,14 @@ func (mc *modCount) allow() bool {
 	return false
 }
 
+func (mc *modCount) reset() { mc.c = mc.n }
+
 type modProb struct{ p float64 }
 
 func (mp *modProb) allow() bool { return rand.Float64() <= mp.p }
 
+func (mp *modProb) reset() {}
+
 type modList struct{ l []mod }
 
 func (ml *modList) allow() bool {
@@ -94,210 +112,229 @@ func (ml *modList) allow() bool {
 	return true
 }
 
-func newTerms(desc string, fp *Failpoint) (*terms, error) {
-	chain, err := parse(desc, fp)
-	if err != nil {
-		return nil, err
-	}
-	t := &terms{chain: chain, desc: desc}
-	for _, c := range chain {
-		c.parent = t
+func (ml *modList) reset() {
+	for _, m := range ml.l {
+		m.reset()
 	}
-	return t, nil
 }
 
-func (t *terms) String() string { return t.desc }
+// chainExpr evaluates the first allowed term, e.g. `(1*sleep(10)->return(1))`
+type chainExpr []*term
 
-func (t *terms) eval() (Value, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	for _, term := range t.chain {
-		if term.mods.allow() {
-			return term.do()
+func (c chainExpr) eval() (Value, error) {
+	for _, t := range c {
+		if !t.mods.allow() {
+			continue
+		}
+		v, err := t.do()
+		// The nested expression is exhausted, try the next term
+		if err == ErrNotAllowed {
+			continue
 		}
+		return v, err
 	}
 	return nil, ErrNotAllowed
 }
 
-// split terms from a -> b -> ... into [a, b, ...]
-func parse(desc string, fp *Failpoint) (chain []*term, err error) {
-	origDesc := desc
-	for len(desc) != 0 {
-		t := parseTerm(desc, fp)
-		if t == nil {
-			return nil, fmt.Errorf("failpoint: failed to parse %q past %q", origDesc, desc)
-		}
-		desc = desc[len(t.desc):]
-		chain = append(chain, t)
-		if len(desc) >= 2 {
-			if !strings.HasPrefix(desc, "->") {
-				return nil, fmt.Errorf("failpoint: failed to parse %q past %q, expected \"->\"", origDesc, desc)
-			}
-			desc = desc[2:]
+func (c chainExpr) reset() {
+	for _, t := range c {
+		t.mods.reset()
+		if t.body != nil {
+			t.body.reset()
 		}
 	}
-	return chain, nil
 }
 
-// <term> :: <mod> <act> [ "(" <val> ")" ]
-func parseTerm(desc string, fp *Failpoint) *term {
-	t := &term{}
-	modStr, mods := parseMod(desc)
-	t.mods = &modList{mods}
-	actStr, act := parseAct(desc[len(modStr):])
-	t.act = act
-	valStr, val := parseVal(desc[len(modStr)+len(actStr):])
-	t.val = val
-	t.desc = desc[:len(modStr)+len(actStr)+len(valStr)]
-	t.fp = fp
-	if len(t.desc) == 0 {
-		return nil
+// loopExpr restarts the chain when it is exhausted, e.g. `loop(2*off->return(true))`
+type loopExpr struct{ chain chainExpr }
+
+func (l *loopExpr) eval() (Value, error) {
+	v, err := l.chain.eval()
+	if err != ErrNotAllowed {
+		return v, err
 	}
-	return t
+	l.chain.reset()
+	return l.chain.eval()
 }
 
-// <mod> :: ((<float>|<int> "%")|(<int> "*" ))*
-func parseMod(desc string) (ret string, mods []mod) {
-	applyPercent := func(s string, v float64) {
-		ret = ret + desc[:len(s)+1]
-		mods = append(mods, &modProb{v / 100.0})
-		desc = desc[len(s)+1:]
-	}
-	applyCount := func(s string, v int) {
-		ret = ret + desc[:len(s)+1]
-		mods = append(mods, &modCount{v})
-		desc = desc[len(s)+1:]
-	}
-	for {
-		s, v := parseIntFloat(desc)
-		if len(s) == 0 {
-			break
-		}
-		if len(s) == len(desc) {
-			return "", nil
-		}
-		switch v := v.(type) {
-		case float64:
-			if desc[len(s)] != '%' {
-				return "", nil
-			}
-			applyPercent(s, v)
-		case int:
-			switch desc[len(s)] {
-			case '%':
-				applyPercent(s, float64(v))
-			case '*':
-				applyCount(s, v)
-			default:
-				return "", nil
-			}
-		default:
-			panic("???")
+func (l *loopExpr) reset() { l.chain.reset() }
+
+// seqExpr runs the actions in sequence and the last action determines
+// the value, e.g. `print("x")+sleep(100)+return(1)`
+type seqExpr []*term
+
+func (s seqExpr) eval() (Value, error) {
+	for _, t := range s[:len(s)-1] {
+		if _, err := t.do(); err != nil {
+			return nil, err
 		}
 	}
-	return ret, mods
+	return s[len(s)-1].do()
 }
 
-// parseIntFloat parses an int or float from a string and returns the string
-// it parsed it from (unlike scanf).
-func parseIntFloat(desc string) (string, interface{}) {
-	// parse for ints
-	i := 0
-	for i < len(desc) {
-		if desc[i] < '0' || desc[i] > '9' {
-			break
+func (s seqExpr) reset() {}
+
+// choiceExpr evaluates a branch picked randomly by the weights,
+// e.g. `{70:return("a"),30:panic}`
+type choiceExpr struct {
+	weights  []float64
+	total    float64
+	branches []chainExpr
+}
+
+func (c *choiceExpr) eval() (Value, error) {
+	n := rand.Float64() * c.total
+	for i, w := range c.weights {
+		if n < w || i == len(c.weights)-1 {
+			return c.branches[i].eval()
 		}
-		i++
+		n -= w
 	}
-	if i == 0 {
-		return "", nil
+	return nil, ErrNotAllowed
+}
+
+func (c *choiceExpr) reset() {
+	for _, b := range c.branches {
+		b.reset()
 	}
+}
 
-	intVal := int(0)
-	_, err := fmt.Sscanf(desc[:i], "%d", &intVal)
+func newTerms(desc string, fp *Failpoint) (*terms, error) {
+	node, err := parseTerms(desc)
 	if err != nil {
-		return "", nil
+		return nil, err
 	}
-	if len(desc) == i {
-		return desc[:i], intVal
+	if err := node.validate(desc, nil); err != nil {
+		return nil, err
 	}
-	if desc[i] != '.' {
-		return desc[:i], intVal
+	t := &terms{desc: desc}
+	t.chain = compileChain(node, t, fp, false)
+	return t, nil
+}
+
+// validate checks the semantics of the parsed terms, i.e. the actions are
+// registered and the weights of the choices are positive. If missing is not nil,
+// the actions which are not registered are added to it instead of being errors.
+func (n *termsNode) validate(desc string, missing map[string]bool) error {
+	for _, t := range n.chain {
+		switch t.kind {
+		case termGroup, termLoop:
+			if err := t.sub.validate(desc, missing); err != nil {
+				return err
+			}
+		case termChoice:
+			total := 0.0
+			for _, br := range t.branches {
+				if err := br.chain.validate(desc, missing); err != nil {
+					return err
+				}
+				total += br.weight
+			}
+			if total <= 0 {
+				return parseError(desc, t.pos, "total weight must be positive")
+			}
+		default:
+			for _, a := range t.actions {
+				if lookupAct(a.act) != nil {
+					continue
+				}
+				if missing == nil {
+					return parseError(desc, a.pos, "")
+				}
+				missing[a.act] = true
+			}
+		}
 	}
+	return nil
+}
 
-	// parse for floats
-	i++
-	if i == len(desc) {
-		return desc[:i], float64(intVal)
+// compileChain converts a validated chain of the AST to executable terms, the
+// terms without a count modifier are run once per cycle if they are in a loop.
+func compileChain(node *termsNode, parent *terms, fp *Failpoint, inLoop bool) chainExpr {
+	chain := make(chainExpr, 0, len(node.chain))
+	for _, n := range node.chain {
+		chain = append(chain, compileTerm(n, parent, fp, inLoop))
 	}
+	return chain
+}
 
-	j := i
-	for i < len(desc) {
-		if desc[i] < '0' || desc[i] > '9' {
-			break
+// compileTerm converts a validated term node of the AST to an executable term
+func compileTerm(n *termNode, parent *terms, fp *Failpoint, inLoop bool) *term {
+	t := &term{
+		desc:   n.String(),
+		parent: parent,
+		fp:     fp,
+	}
+	mods := make([]mod, 0, len(n.mods)+1)
+	counted := false
+	for _, m := range n.mods {
+		switch m.kind {
+		case modKindCount:
+			mods = append(mods, &modCount{m.count, m.count})
+			counted = true
+		case modKindProb:
+			mods = append(mods, &modProb{m.percent / 100.0})
 		}
-		i++
 	}
-	if j == i {
-		return desc[:i], float64(intVal)
+	if inLoop && !counted {
+		mods = append(mods, &modCount{1, 1})
 	}
+	t.mods = &modList{mods}
 
-	f := float64(0)
-	if _, err = fmt.Sscanf(desc[:i], "%f", &f); err != nil {
-		return "", nil
+	switch n.kind {
+	case termGroup:
+		t.body = compileChain(n.sub, parent, fp, false)
+	case termLoop:
+		t.body = &loopExpr{chain: compileChain(n.sub, parent, fp, true)}
+	case termChoice:
+		choice := &choiceExpr{}
+		for _, br := range n.branches {
+			choice.weights = append(choice.weights, br.weight)
+			choice.total += br.weight
+			choice.branches = append(choice.branches, compileChain(br.chain, parent, fp, false))
+		}
+		t.body = choice
+	default:
+		steps := make(seqExpr, 0, len(n.actions))
+		for _, a := range n.actions {
+			steps = append(steps, &term{
+				desc:   a.String(),
+				mods:   &modList{},
+				act:    lookupAct(a.act),
+				val:    a.val,
+				parent: parent,
+				fp:     fp,
+			})
+		}
+		if len(steps) == 1 {
+			t.act, t.val = steps[0].act, steps[0].val
+		} else {
+			t.body = steps
+		}
 	}
-	return desc[:i], f
+	return t
 }
 
-// parseAct parses an action
-// <act> :: "off" | "return" | "sleep" | "panic" | "break" | "print" | "pause"
-func parseAct(desc string) (string, actFunc) {
-	for k, v := range actMap {
-		if strings.HasPrefix(desc, k) {
-			return k, v
-		}
-	}
-	return "", nil
+func (t *terms) String() string { return t.desc }
+
+func (t *terms) eval() (Value, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return chainExpr(t.chain).eval()
 }
 
-// <val> :: <int> | <string> | <bool> | <nothing>
-func parseVal(desc string) (string, interface{}) {
-	// return => struct{}
-	if len(desc) == 0 {
-		return "", struct{}{}
-	}
-	// malformed
-	if len(desc) == 1 || desc[0] != '(' {
-		return "", nil
-	}
-	// return() => struct{}
-	if desc[1] == ')' {
-		return "()", struct{}{}
-	}
-	// return("s") => string
-	s := ""
-	n, err := fmt.Sscanf(desc[1:], "%q", &s)
-	if n == 1 && err == nil {
-		return desc[:len(s)+4], s
-	}
-	// return(1) => int
-	v := 0
-	n, err = fmt.Sscanf(desc[1:], "%d", &v)
-	if n == 1 && err == nil {
-		return desc[:len(fmt.Sprintf("%d", v))+2], v
-	}
-	// return(true) => bool
-	b := false
-	n, err = fmt.Sscanf(desc[1:], "%t", &b)
-	if n == 1 && err == nil {
-		return desc[:len(fmt.Sprintf("%t", b))+2], b
-	}
-	// unknown type; malformed input?
-	return "", nil
+// lookupAct returns the action registered with the name, or nil if not found
+func lookupAct(name string) actFunc {
+	actMu.RLock()
+	defer actMu.RUnlock()
+	return actMap[name]
 }
 
 type actFunc func(*term) (interface{}, error)
 
+// actMu protects actMap from the concurrent RegisterAction and lookupAct
+var actMu sync.RWMutex
+
 var actMap = map[string]actFunc{
 	"off":    actOff,
 	"return": actReturn,
@@ -308,7 +345,124 @@ var actMap = map[string]actFunc{
 	"pause":  actPause,
 }
 
-func (t *term) do() (interface{}, error) { return t.act(t) }
+// ActionContext describes the term which is evaluating a registered action
+type ActionContext struct {
+	// Name is the failpath of the evaluating failpoint
+	Name string
+	// Value is the argument of the action, e.g. `8` in `corrupt(8)`,
+	// it is struct{}{} if the action has no argument.
+	Value Value
+}
+
+// RegisterAction registers a user-defined action which can be used by name
+// in the failpoint terms, e.g. after registering "corrupt", the failpoint can be
+// enabled by `GO_FAILPOINTS="name=1*corrupt(8)->off"`. The value returned by fn
+// will be returned by the failpoint evaluation.
+// The action name must be an identifier and can not be registered twice.
+// As GO_FAILPOINTS is parsed before the program can register its actions, the
+// failpoints of GO_FAILPOINTS are enabled once all of their actions are registered.
+func RegisterAction(name string, fn func(ActionContext) (Value, error)) error {
+	if fn == nil {
+		return fmt.Errorf("failpoint: action %q has nil function", name)
+	}
+	if !isActionName(name) || name == loopKeyword {
+		return fmt.Errorf("failpoint: invalid action name %q", name)
+	}
+	actMu.Lock()
+	if _, found := actMap[name]; found {
+		actMu.Unlock()
+		return fmt.Errorf("failpoint: action %q already registered", name)
+	}
+	actMap[name] = func(t *term) (interface{}, error) {
+		ctx := ActionContext{Value: t.val}
+		if t.fp != nil {
+			ctx.Name = t.fp.name
+		}
+		return fn(ctx)
+	}
+	var ready []*pendingTerms
+	remain := pending[:0]
+	for _, p := range pending {
+		delete(p.missing, name)
+		if len(p.missing) == 0 {
+			ready = append(ready, p)
+		} else {
+			remain = append(remain, p)
+		}
+	}
+	pending = remain
+	actMu.Unlock()
+
+	for _, p := range ready {
+		if err := Enable(p.failpath, p.desc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingTerms are the terms of a failpoint in GO_FAILPOINTS, which use the
+// actions not registered yet
+type pendingTerms struct {
+	failpath string
+	desc     string
+	missing  map[string]bool
+}
+
+// pending are the terms waiting for their actions, which are guarded by actMu
+var pending []*pendingTerms
+
+// enableEnv enables a failpoint of GO_FAILPOINTS. If its terms use the actions
+// not registered yet, the failpoint is enabled when they are registered.
+func enableEnv(failpath, desc string) error {
+	node, err := parseTerms(desc)
+	if err != nil {
+		return errors.Wrapf(err, "error on %s", failpath)
+	}
+	missing := map[string]bool{}
+	if err := node.validate(desc, missing); err != nil {
+		return errors.Wrapf(err, "error on %s", failpath)
+	}
+	if len(missing) == 0 {
+		return Enable(failpath, desc)
+	}
+	actMu.Lock()
+	// The actions may have been registered since the terms were validated
+	for name := range missing {
+		if actMap[name] != nil {
+			delete(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		actMu.Unlock()
+		return Enable(failpath, desc)
+	}
+	pending = append(pending, &pendingTerms{failpath: failpath, desc: desc, missing: missing})
+	actMu.Unlock()
+	return nil
+}
+
+func isActionName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (t *term) do() (interface{}, error) {
+	if t.body != nil {
+		return t.body.eval()
+	}
+	return t.act(t)
+}
 
 func actOff(t *term) (interface{}, error) { return nil, nil }
 
@@ -371,6 +525,10 @@ func actBreak(t *term) (interface{}, error) {
 }
 
 func actPrint(t *term) (interface{}, error) {
-	fmt.Println("failpoint print:", t.val)
+	var name string
+	if t.fp != nil {
+		name = t.fp.name
+	}
+	logMsg(fmt.Sprint("failpoint print: ", t.val), "failpoint", name, "action", "print", "value", t.val)
 	return nil, nil
 }
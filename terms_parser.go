@@ -0,0 +1,564 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failpoint
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The terms language:
+//
+//	<fp>     :: <chain> [ "->" ]
+//	<chain>  :: <term> ( "->" <term> )*
+//	<term>   :: <mod>* ( <group> | <loop> | <choice> | <action> ( "+" <action> )* )
+//	<group>  :: "(" <chain> ")"
+//	<loop>   :: "loop" "(" <chain> ")"
+//	<choice> :: "{" <branch> ( "," <branch> )* "}"
+//	<branch> :: ( <int> | <float> ) ":" <chain>
+//	<action> :: <ident> [ "(" [ <val> ] ")" ]
+//	<mod>    :: ( <int> | <float> ) "%" | <int> "*"
+//	<val>    :: <int> | <float> | <string> | "true" | "false"
+//
+// The description is split into tokens by the lexer and then parsed by a
+// recursive-descent parser into an AST. The AST is compiled into the
+// executable terms chain by newTerms.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokInt
+	tokFloat
+	tokString
+	tokArrow
+	tokPercent
+	tokStar
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokComma
+	tokColon
+	tokPlus
+)
+
+var tokenNames = [...]string{
+	tokEOF:     "end of terms",
+	tokIdent:   "identifier",
+	tokInt:     "integer",
+	tokFloat:   "float",
+	tokString:  "string",
+	tokArrow:   `"->"`,
+	tokPercent: `"%"`,
+	tokStar:    `"*"`,
+	tokLParen:  `"("`,
+	tokRParen:  `")"`,
+	tokLBrace:  `"{"`,
+	tokRBrace:  `"}"`,
+	tokComma:   `","`,
+	tokColon:   `":"`,
+	tokPlus:    `"+"`,
+}
+
+func (k tokenKind) String() string { return tokenNames[k] }
+
+type token struct {
+	kind tokenKind
+	// text is the raw text of the token in the description
+	text string
+	// pos is the byte offset of the token in the description
+	pos int
+}
+
+type lexer struct {
+	desc string
+	pos  int
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdentByte(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && isDigit(c))
+}
+
+// next returns the next token, the position of the returned error is the
+// offset where the lexer fails to recognize a token.
+func (l *lexer) next() (token, int, error) {
+	for l.pos < len(l.desc) && (l.desc[l.pos] == ' ' || l.desc[l.pos] == '\t') {
+		l.pos++
+	}
+	start := l.pos
+	if start >= len(l.desc) {
+		return token{kind: tokEOF, pos: start}, 0, nil
+	}
+	emit := func(kind tokenKind, end int) (token, int, error) {
+		l.pos = end
+		return token{kind: kind, text: l.desc[start:end], pos: start}, 0, nil
+	}
+
+	c := l.desc[start]
+	switch {
+	case c == '(':
+		return emit(tokLParen, start+1)
+	case c == ')':
+		return emit(tokRParen, start+1)
+	case c == '%':
+		return emit(tokPercent, start+1)
+	case c == '*':
+		return emit(tokStar, start+1)
+	case c == '{':
+		return emit(tokLBrace, start+1)
+	case c == '}':
+		return emit(tokRBrace, start+1)
+	case c == ',':
+		return emit(tokComma, start+1)
+	case c == ':':
+		return emit(tokColon, start+1)
+	case c == '+':
+		return emit(tokPlus, start+1)
+	case c == '-' && strings.HasPrefix(l.desc[start:], "->"):
+		return emit(tokArrow, start+2)
+	case c == '"' || c == '`':
+		quoted, err := strconv.QuotedPrefix(l.desc[start:])
+		if err != nil {
+			return token{}, start, fmt.Errorf("unterminated string")
+		}
+		return emit(tokString, start+len(quoted))
+	case isDigit(c) || (c == '-' && start+1 < len(l.desc) && isDigit(l.desc[start+1])):
+		end := start + 1
+		for end < len(l.desc) && isDigit(l.desc[end]) {
+			end++
+		}
+		if end >= len(l.desc) || l.desc[end] != '.' {
+			return emit(tokInt, end)
+		}
+		end++
+		for end < len(l.desc) && isDigit(l.desc[end]) {
+			end++
+		}
+		return emit(tokFloat, end)
+	case isIdentByte(c, true):
+		end := start + 1
+		for end < len(l.desc) && isIdentByte(l.desc[end], false) {
+			end++
+		}
+		return emit(tokIdent, end)
+	}
+	return token{}, start, fmt.Errorf("unexpected character %q", c)
+}
+
+// loopKeyword starts a loop term, so it can not be used as an action name
+const loopKeyword = "loop"
+
+// termsNode represents a chain of terms, it is also the root of the terms AST
+type termsNode struct {
+	chain []*termNode
+}
+
+type termKind int
+
+const (
+	// termAction is a term which runs a sequence of actions, e.g. `50%2*return(1)`
+	// or `print("x")+sleep(100)+return(1)`, the last action determines the value.
+	termAction termKind = iota
+	// termGroup is a parenthesized chain, e.g. `3*(1*sleep(10)->return(1))`
+	termGroup
+	// termLoop is a chain which restarts when exhausted, e.g. `loop(2*off->return(true))`
+	termLoop
+	// termChoice picks a weighted branch randomly, e.g. `{70:return("a"),30:panic}`
+	termChoice
+)
+
+// termNode represents a single term of a chain
+type termNode struct {
+	mods []*modNode
+	kind termKind
+	// actions are used by termAction
+	actions []*actionNode
+	// sub is the nested chain of termGroup and termLoop
+	sub *termsNode
+	// branches are the alternatives of termChoice
+	branches []*branchNode
+	// pos and end are the byte offsets of the term in the description
+	pos, end int
+}
+
+// actionNode represents an action, e.g. `return(1)`
+type actionNode struct {
+	act string
+	// val is the typed argument of the action, it is struct{}{}
+	// if the action has no argument.
+	val interface{}
+	// pos and end are the byte offsets of the action in the description
+	pos, end int
+}
+
+// branchNode is a weighted alternative of a choice term
+type branchNode struct {
+	weight float64
+	chain  *termsNode
+}
+
+type modKind int
+
+const (
+	modKindCount modKind = iota
+	modKindProb
+)
+
+// modNode represents a modifier, e.g. `2*` or `50%`
+type modNode struct {
+	kind modKind
+	// count is used by modKindCount
+	count int
+	// percent is used by modKindProb, it is in the range of [0, 100] usually
+	percent float64
+}
+
+func (n *termsNode) String() string {
+	descs := make([]string, 0, len(n.chain))
+	for _, t := range n.chain {
+		descs = append(descs, t.String())
+	}
+	return strings.Join(descs, "->")
+}
+
+func (n *termNode) String() string {
+	var b strings.Builder
+	for _, m := range n.mods {
+		b.WriteString(m.String())
+	}
+	switch n.kind {
+	case termGroup:
+		b.WriteString("(" + n.sub.String() + ")")
+	case termLoop:
+		b.WriteString(loopKeyword + "(" + n.sub.String() + ")")
+	case termChoice:
+		branches := make([]string, 0, len(n.branches))
+		for _, br := range n.branches {
+			branches = append(branches, strconv.FormatFloat(br.weight, 'f', -1, 64)+":"+br.chain.String())
+		}
+		b.WriteString("{" + strings.Join(branches, ",") + "}")
+	default:
+		acts := make([]string, 0, len(n.actions))
+		for _, a := range n.actions {
+			acts = append(acts, a.String())
+		}
+		b.WriteString(strings.Join(acts, "+"))
+	}
+	return b.String()
+}
+
+func (n *actionNode) String() string {
+	if _, ok := n.val.(struct{}); ok {
+		return n.act
+	}
+	return n.act + "(" + formatVal(n.val) + ")"
+}
+
+func (n *modNode) String() string {
+	if n.kind == modKindCount {
+		return strconv.Itoa(n.count) + "*"
+	}
+	return strconv.FormatFloat(n.percent, 'f', -1, 64) + "%"
+}
+
+func formatVal(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return strconv.Quote(v)
+	case float64:
+		s := strconv.FormatFloat(v, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type parser struct {
+	lex  lexer
+	tok  token
+	desc string
+}
+
+// parseTerms parses the description into the terms AST
+func parseTerms(desc string) (*termsNode, error) {
+	p := &parser{lex: lexer{desc: desc}, desc: desc}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	// An empty description is a valid terms which is never allowed
+	if p.tok.kind == tokEOF {
+		return &termsNode{}, nil
+	}
+	node, err := p.parseChain()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf(p.tok.pos, `expected "->"`)
+	}
+	return node, nil
+}
+
+// <chain> :: <term> ( "->" <term> )*
+func (p *parser) parseChain() (*termsNode, error) {
+	node := &termsNode{}
+	for {
+		t, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		node.chain = append(node.chain, t)
+		if p.tok.kind != tokArrow {
+			return node, nil
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		// A trailing arrow is allowed at the end of the terms, e.g. `return(1)->`
+		if p.tok.kind == tokEOF {
+			return node, nil
+		}
+	}
+}
+
+func (p *parser) advance() error {
+	tok, pos, err := p.lex.next()
+	if err != nil {
+		return p.errorf(pos, "%v", err)
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return parseError(p.desc, pos, fmt.Sprintf(format, args...))
+}
+
+// parseError reports that desc can not be parsed past the offset pos
+func parseError(desc string, pos int, detail string) error {
+	if detail == "" {
+		return fmt.Errorf("failpoint: failed to parse %q past %q", desc, desc[pos:])
+	}
+	return fmt.Errorf("failpoint: failed to parse %q past %q, %s", desc, desc[pos:], detail)
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	tok := p.tok
+	if tok.kind != kind {
+		return tok, p.errorf(tok.pos, "expected %v", kind)
+	}
+	return tok, p.advance()
+}
+
+// <term> :: <mod>* ( <group> | <loop> | <choice> | <action> )
+func (p *parser) parseTerm() (*termNode, error) {
+	t := &termNode{pos: p.tok.pos}
+	for p.tok.kind == tokInt || p.tok.kind == tokFloat {
+		m, err := p.parseMod()
+		if err != nil {
+			return nil, err
+		}
+		t.mods = append(t.mods, m)
+	}
+
+	var err error
+	switch {
+	case p.tok.kind == tokLParen:
+		t.kind = termGroup
+		t.sub, t.end, err = p.parseSubChain()
+	case p.tok.kind == tokIdent && p.tok.text == loopKeyword:
+		t.kind = termLoop
+		if err = p.advance(); err != nil {
+			return nil, err
+		}
+		t.sub, t.end, err = p.parseSubChain()
+	case p.tok.kind == tokLBrace:
+		t.kind = termChoice
+		err = p.parseChoice(t)
+	default:
+		err = p.parseActions(t)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parseSubChain parses `"(" <chain> ")"` and returns the end offset
+func (p *parser) parseSubChain() (*termsNode, int, error) {
+	if _, err := p.expect(tokLParen); err != nil {
+		return nil, 0, err
+	}
+	sub, err := p.parseChain()
+	if err != nil {
+		return nil, 0, err
+	}
+	rparen, err := p.expect(tokRParen)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sub, rparen.pos + 1, nil
+}
+
+// <choice> :: "{" <branch> ( "," <branch> )* "}"
+// <branch> :: ( <int> | <float> ) ":" <chain>
+func (p *parser) parseChoice(t *termNode) error {
+	if _, err := p.expect(tokLBrace); err != nil {
+		return err
+	}
+	for {
+		num := p.tok
+		if num.kind != tokInt && num.kind != tokFloat {
+			return p.errorf(num.pos, "expected weight")
+		}
+		weight, err := strconv.ParseFloat(num.text, 64)
+		if err != nil || weight < 0 {
+			return p.errorf(num.pos, "invalid weight %s", num.text)
+		}
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if _, err := p.expect(tokColon); err != nil {
+			return err
+		}
+		chain, err := p.parseChain()
+		if err != nil {
+			return err
+		}
+		t.branches = append(t.branches, &branchNode{weight: weight, chain: chain})
+		if p.tok.kind != tokComma {
+			break
+		}
+		if err := p.advance(); err != nil {
+			return err
+		}
+	}
+	rbrace, err := p.expect(tokRBrace)
+	if err != nil {
+		return err
+	}
+	t.end = rbrace.pos + 1
+	return nil
+}
+
+// <action> ( "+" <action> )*
+func (p *parser) parseActions(t *termNode) error {
+	for {
+		a, err := p.parseAction()
+		if err != nil {
+			return err
+		}
+		t.actions = append(t.actions, a)
+		t.end = a.end
+		if p.tok.kind != tokPlus {
+			return nil
+		}
+		if err := p.advance(); err != nil {
+			return err
+		}
+	}
+}
+
+// <action> :: <ident> [ "(" [ <val> ] ")" ]
+func (p *parser) parseAction() (*actionNode, error) {
+	act, err := p.expect(tokIdent)
+	if err != nil {
+		return nil, err
+	}
+	a := &actionNode{
+		act: act.text,
+		val: struct{}{},
+		pos: act.pos,
+		end: act.pos + len(act.text),
+	}
+
+	if p.tok.kind == tokLParen {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			if a.val, err = p.parseVal(); err != nil {
+				return nil, err
+			}
+		}
+		rparen, err := p.expect(tokRParen)
+		if err != nil {
+			return nil, err
+		}
+		a.end = rparen.pos + 1
+	}
+	return a, nil
+}
+
+// <mod> :: ( <int> | <float> ) "%" | <int> "*"
+func (p *parser) parseMod() (*modNode, error) {
+	num := p.tok
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	switch {
+	case p.tok.kind == tokPercent:
+		v, err := strconv.ParseFloat(num.text, 64)
+		if err != nil || v < 0 {
+			return nil, p.errorf(num.pos, "invalid percentage %s", num.text)
+		}
+		return &modNode{kind: modKindProb, percent: v}, p.advance()
+	case p.tok.kind == tokStar && num.kind == tokInt:
+		v, err := strconv.Atoi(num.text)
+		if err != nil || v < 0 {
+			return nil, p.errorf(num.pos, "invalid count %s", num.text)
+		}
+		return &modNode{kind: modKindCount, count: v}, p.advance()
+	case p.tok.kind == tokStar:
+		return nil, p.errorf(num.pos, "count must be an integer")
+	}
+	return nil, p.errorf(p.tok.pos, `expected "%%" or "*"`)
+}
+
+// <val> :: <int> | <float> | <string> | "true" | "false"
+func (p *parser) parseVal() (interface{}, error) {
+	tok := p.tok
+	var (
+		val interface{}
+		err error
+	)
+	switch tok.kind {
+	case tokInt:
+		val, err = strconv.Atoi(tok.text)
+	case tokFloat:
+		val, err = strconv.ParseFloat(tok.text, 64)
+	case tokString:
+		val, err = strconv.Unquote(tok.text)
+	case tokIdent:
+		val, err = strconv.ParseBool(tok.text)
+		if tok.text != "true" && tok.text != "false" {
+			err = fmt.Errorf("unknown value")
+		}
+	default:
+		return nil, p.errorf(tok.pos, "expected value")
+	}
+	if err != nil {
+		return nil, p.errorf(tok.pos, "invalid value %s", tok.text)
+	}
+	return val, p.advance()
+}
@@ -0,0 +1,139 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failpoint
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTerms(t *testing.T) {
+	tests := []struct {
+		desc   string
+		canon  string
+		values []interface{}
+	}{
+		{`off`, `off`, []interface{}{struct{}{}}},
+		{`return`, `return`, []interface{}{struct{}{}}},
+		{`return()`, `return`, []interface{}{struct{}{}}},
+		{`return(007)`, `return(7)`, []interface{}{7}},
+		{`return(-1)`, `return(-1)`, []interface{}{-1}},
+		{`return(1.5)`, `return(1.5)`, []interface{}{1.5}},
+		{`return(2.)`, `return(2.0)`, []interface{}{2.0}},
+		{`return(true)`, `return(true)`, []interface{}{true}},
+		{`return("a->b(c)")`, `return("a->b(c)")`, []interface{}{"a->b(c)"}},
+		{"return(`raw\\n`)", `return("raw\\n")`, []interface{}{`raw\n`}},
+		{`sleep("100ms")`, `sleep("100ms")`, []interface{}{"100ms"}},
+		{`50.0%2*return(5)`, `50%2*return(5)`, []interface{}{5}},
+		{` 1* return ( 1 ) -> off `, `1*return(1)->off`, []interface{}{1, struct{}{}}},
+		{`off->panic->return(1)`, `off->panic->return(1)`, []interface{}{struct{}{}, struct{}{}, 1}},
+		{`3*(sleep(10)->return(1))`, `3*(sleep(10)->return(1))`, []interface{}{struct{}{}}},
+		{`{70:return("a"), 30.5:panic}->off`, `{70:return("a"),30.5:panic}->off`, []interface{}{struct{}{}, struct{}{}}},
+		{`loop(2*off->return(true))`, `loop(2*off->return(true))`, []interface{}{struct{}{}}},
+		{`50%(loop({1:off,1:1*(return(1))}))`, `50%(loop({1:off,1:1*(return(1))}))`, []interface{}{struct{}{}}},
+		{`print("x") + sleep(100)+return(1)->off`, `print("x")+sleep(100)+return(1)->off`, []interface{}{1, struct{}{}}},
+		{`2*(print+return(1))`, `2*(print+return(1))`, []interface{}{struct{}{}}},
+	}
+	for _, tt := range tests {
+		node, err := parseTerms(tt.desc)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.desc, err)
+		}
+		if s := node.String(); s != tt.canon {
+			t.Fatalf("%q: got %q, expected %q", tt.desc, s, tt.canon)
+		}
+		if len(node.chain) != len(tt.values) {
+			t.Fatalf("%q: got %d terms, expected %d", tt.desc, len(node.chain), len(tt.values))
+		}
+		for i, n := range node.chain {
+			// the value of the last action, or struct{}{} for the nested terms
+			var val interface{} = struct{}{}
+			if len(n.actions) > 0 {
+				val = n.actions[len(n.actions)-1].val
+			}
+			if !reflect.DeepEqual(val, tt.values[i]) {
+				t.Fatalf("%q: got %#v, expected %#v", tt.desc, val, tt.values[i])
+			}
+		}
+	}
+}
+
+func TestParseTermsError(t *testing.T) {
+	tests := []struct {
+		desc string
+		err  string
+	}{
+		{`return(1`, `past "", expected ")"`},
+		{`return(1)x`, `past "x", expected "->"`},
+		{`return(1)->->`, `past "->", expected identifier`},
+		{`(return(1)->)`, `past ")", expected identifier`},
+		{`return(abc)`, `past "abc)", invalid value abc`},
+		{`return("abc)`, `past "\"abc)", unterminated string`},
+		{`return(99999999999999999999)`, `invalid value 99999999999999999999`},
+		{`1.5*return`, `past "1.5*return", count must be an integer`},
+		{`1return`, `past "return", expected "%" or "*"`},
+		{`return(1)#`, `past "#", unexpected character '#'`},
+		{`3*()`, `past ")", expected identifier`},
+		{`3*(return(1)`, `past "", expected ")"`},
+		{`loop`, `past "", expected "("`},
+		{`{return(1)}`, `past "return(1)}", expected weight`},
+		{`{1return(1)}`, `past "return(1)}", expected ":"`},
+		{`{1:return(1);2:off}`, `past ";2:off}", unexpected character ';'`},
+		{`{1:return(1),2:off`, `past "", expected "}"`},
+		{`print("x")+`, `past "", expected identifier`},
+		{`print("x")+(return(1))`, `past "(return(1))", expected identifier`},
+	}
+	for _, tt := range tests {
+		_, err := parseTerms(tt.desc)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("%q: got error %v, expected %q", tt.desc, err, tt.err)
+		}
+	}
+}
+
+func FuzzParseTerms(f *testing.F) {
+	for _, desc := range []string{
+		`off`,
+		`return`,
+		`return(1)`,
+		`return("abc")`,
+		`return(true)`,
+		`sleep("10ms")`,
+		`50.0%2*return(5)->1*return(true)->off`,
+		`panic("boom")`,
+		`3*(1*sleep(10)->return(1))`,
+		`{70:return("a"),30:panic}`,
+		`loop(2*off->return(true))`,
+		`1*print("x")+sleep(100)+return(1)->off`,
+	} {
+		f.Add(desc)
+	}
+	f.Fuzz(func(t *testing.T, desc string) {
+		node, err := parseTerms(desc)
+		if err != nil {
+			return
+		}
+		// The canonical form must be parsed to the same AST
+		canon := node.String()
+		reparsed, err := parseTerms(canon)
+		if err != nil {
+			t.Fatalf("%q: canonical form %q can not be parsed: %v", desc, canon, err)
+		}
+		if s := reparsed.String(); s != canon {
+			t.Fatalf("%q: canonical form is not stable, %q != %q", desc, s, canon)
+		}
+	})
+}
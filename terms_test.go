@@ -29,8 +29,10 @@
 package failpoint
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestTermsString(t *testing.T) {
@@ -92,3 +94,215 @@ func TestTermsTypes(t *testing.T) {
 		}
 	}
 }
+
+func TestEnableEnvPendingAction(t *testing.T) {
+	defer func() {
+		actMu.Lock()
+		delete(actMap, "envact")
+		actMu.Unlock()
+		_ = Disable("env-pending")
+	}()
+
+	// The terms with the actions not registered yet are enabled by RegisterAction
+	if err := enableEnv("env-pending", `1*envact(2)->return(3)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Eval("env-pending"); err == nil {
+		t.Fatal("expected the failpoint to be disabled before the action is registered")
+	}
+	err := RegisterAction("envact", func(ctx ActionContext) (Value, error) {
+		return ctx.Value, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int{2, 3} {
+		if v, err := Eval("env-pending"); err != nil || v != want {
+			t.Fatalf("expected %v, got %v, %v", want, v, err)
+		}
+	}
+
+	// The other errors are reported at once
+	for _, desc := range []string{`envact2(`, `{0:envact2(),0:off}`} {
+		if err := enableEnv("env-bad", desc); err == nil {
+			t.Fatalf("expected error for %q", desc)
+		}
+	}
+}
+
+func TestRegisterAction(t *testing.T) {
+	defer func() {
+		actMu.Lock()
+		delete(actMap, "returnErr")
+		delete(actMap, "dropconn")
+		actMu.Unlock()
+	}()
+
+	errFn := func(ctx ActionContext) (Value, error) {
+		return nil, fmt.Errorf("%v", ctx.Value)
+	}
+	if err := RegisterAction("returnErr", errFn); err != nil {
+		t.Fatal(err)
+	}
+	var dropped []string
+	dropFn := func(ctx ActionContext) (Value, error) {
+		dropped = append(dropped, ctx.Name)
+		return ctx.Value, nil
+	}
+	if err := RegisterAction("dropconn", dropFn); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", "1abc", "drop-conn", "drop conn"} {
+		if err := RegisterAction(name, dropFn); err == nil {
+			t.Fatalf("expected error for action name %q", name)
+		}
+	}
+	for _, name := range []string{"return", "dropconn"} {
+		if err := RegisterAction(name, dropFn); err == nil {
+			t.Fatalf("expected error for duplicated action %q", name)
+		}
+	}
+	if err := RegisterAction("nilfn", nil); err == nil {
+		t.Fatal("expected error for nil action")
+	}
+
+	// `returnErr` must never be parsed as `return` followed by garbage
+	for i := 0; i < 20; i++ {
+		ter, err := newTerms(`returnErr("boom")`, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := ter.eval()
+		if v != nil || err == nil || err.Error() != "boom" {
+			t.Fatalf("got %v, %v, expected error boom", v, err)
+		}
+	}
+
+	fp := &Failpoint{name: "test-dropconn"}
+	ter, err := newTerms(`1*dropconn()->return(1)`, fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := ter.eval()
+	if err != nil || !reflect.DeepEqual(v, struct{}{}) {
+		t.Fatalf("got %v, %v, expected struct{}{}", v, err)
+	}
+	v, err = ter.eval()
+	if err != nil || v.(int) != 1 {
+		t.Fatalf("got %v, %v, expected 1", v, err)
+	}
+	if !reflect.DeepEqual(dropped, []string{"test-dropconn"}) {
+		t.Fatalf("got %v, expected [test-dropconn]", dropped)
+	}
+}
+
+func TestTermsNested(t *testing.T) {
+	tests := []struct {
+		desc  string
+		weval []interface{}
+	}{
+		{`2*(1*return(1)->return(2))->return(3)`, []interface{}{1, 2, 3, 3}},
+		{`2*(1*return(1))->return(3)`, []interface{}{1, 3, 3}},
+		{`loop(2*off->return(true))`, []interface{}{nil, nil, true, nil, nil, true}},
+		{`loop(1*return(1)->2*return(2))`, []interface{}{1, 2, 2, 1, 2, 2}},
+		{`1*loop(return(1)->return(2))->return(3)`, []interface{}{1, 3}},
+		{`{1:return("a"),0:return("b")}`, []interface{}{"a", "a", "a"}},
+		{`{0:return("a"),1:1*return("b")}->return("c")`, []interface{}{"b", "c", "c"}},
+		{`{1:loop(return(1)->return(2))}`, []interface{}{1, 2, 1, 2}},
+	}
+	for _, tt := range tests {
+		ter, err := newTerms(tt.desc, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, w := range tt.weval {
+			v, err := ter.eval()
+			if err != nil {
+				t.Fatalf("%q #%d: %v", tt.desc, i, err)
+			}
+			if !reflect.DeepEqual(v, w) {
+				t.Fatalf("%q #%d: got %v, expected %v", tt.desc, i, v, w)
+			}
+		}
+	}
+
+	if _, err := newTerms(`{0:return(1),0:off}`, nil); err == nil {
+		t.Fatal("expected error for zero total weight")
+	}
+	if _, err := newTerms(`(unknown)`, nil); err == nil {
+		t.Fatal("expected error for unknown action")
+	}
+	if err := RegisterAction("loop", func(ActionContext) (Value, error) { return nil, nil }); err == nil {
+		t.Fatal("expected error for reserved action name")
+	}
+}
+
+func TestTermsChoiceWeights(t *testing.T) {
+	ter, err := newTerms(`{70:return("a"),30:return("b")}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a int
+	for i := 0; i < 1000; i++ {
+		v, err := ter.eval()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.(string) == "a" {
+			a++
+		}
+	}
+	if a < 620 || a > 780 {
+		t.Fatalf("weighted choice failure: %v", a)
+	}
+}
+
+func TestTermsComposite(t *testing.T) {
+	defer func() {
+		actMu.Lock()
+		delete(actMap, "record")
+		actMu.Unlock()
+	}()
+	var records []interface{}
+	err := RegisterAction("record", func(ctx ActionContext) (Value, error) {
+		records = append(records, ctx.Value)
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ter, err := newTerms(`1*record("a")+sleep(10)+record("b")+return(1)->record("c")+off`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	v, err := ter.eval()
+	if err != nil || v.(int) != 1 {
+		t.Fatalf("got %v, %v, expected 1", v, err)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Fatal("sleep is not executed")
+	}
+	v, err = ter.eval()
+	if err != nil || v != nil {
+		t.Fatalf("got %v, %v, expected nil", v, err)
+	}
+	if !reflect.DeepEqual(records, []interface{}{"a", "b", "c"}) {
+		t.Fatalf("got %v, expected [a b c]", records)
+	}
+
+	// The sequence stops at the first failed action
+	records = nil
+	ter, err = newTerms(`record("a")+sleep(true)+record("b")+return(1)`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ter.eval(); err == nil {
+		t.Fatalf("got %v, expected error", v)
+	}
+	if !reflect.DeepEqual(records, []interface{}{"a"}) {
+		t.Fatalf("got %v, expected [a]", records)
+	}
+}
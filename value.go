@@ -0,0 +1,158 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failpoint
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// EvalAs evaluates a failpoint's value and converts it to the type T, it is
+// injected for the failpoint closures whose parameter type is not `Value`,
+// e.g. `failpoint.Inject("fail-point-name", func(n int) {...})`. The error is
+// logged if the value can not be converted, and the closure is skipped.
+func EvalAs[T any](failpath string) (T, error) {
+	var zero T
+	val, err := Eval(failpath)
+	if err != nil {
+		return zero, err
+	}
+	return convertValue[T](failpath, val)
+}
+
+// EvalContextAs is the same as EvalAs but evaluates the failpoint's value by
+// EvalContext, it is injected for `failpoint.InjectContext`.
+func EvalContextAs[T any](ctx context.Context, failpath string) (T, error) {
+	var zero T
+	val, err := EvalContext(ctx, failpath)
+	if err != nil {
+		return zero, err
+	}
+	return convertValue[T](failpath, val)
+}
+
+// EvalOverride evaluates a failpoint's value and converts it to the type T, the
+// val is returned if the failpoint is not enabled or the value can not be
+// converted. It is injected for `failpoint.Override`.
+func EvalOverride[T any](failpath string, val T) T {
+	v, err := EvalAs[T](failpath)
+	if err != nil {
+		return val
+	}
+	return v
+}
+
+// convertValue converts the value of the failpoint to the type T. Besides the
+// values of the type T, the following values are accepted:
+//
+//  1. no value, e.g. `return`, for the types which can be nil, e.g. `error`
+//  2. a string for `time.Duration`, which is parsed by `time.ParseDuration`,
+//     or an int which is in milliseconds, the same as `sleep`
+//  3. a string for `error`, which is the message of the error
+//  4. an int for the integer and float types, and a float for the float types,
+//     the value must be in the range of the type
+//  5. the values which can be converted to the types defined on them, e.g.
+//     a string for `type Mode string`
+func convertValue[T any](failpath string, val Value) (T, error) {
+	var zero T
+	if v, ok := val.(T); ok {
+		return v, nil
+	}
+	typ := reflect.TypeOf(&zero).Elem()
+	if converted, ok := convertReflect(val, typ); ok {
+		var v T
+		reflect.ValueOf(&v).Elem().Set(converted)
+		return v, nil
+	}
+	err := errors.Wrapf(ErrValueType, "can not use %#v as %s", val, typ)
+	logMsg(fmt.Sprintf("failpoint %s: %s", failpath, err), "failpoint", failpath, "value", val, "error", err)
+	return zero, err
+}
+
+func convertReflect(val Value, typ reflect.Type) (reflect.Value, bool) {
+	// The actions without argument evaluate to struct{}{}
+	if val == nil || val == (struct{}{}) {
+		switch typ.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+			return reflect.Zero(typ), true
+		}
+		return reflect.Value{}, false
+	}
+	if typ == durationType {
+		switch v := val.(type) {
+		case string:
+			dur, err := time.ParseDuration(v)
+			return reflect.ValueOf(dur), err == nil
+		case int:
+			return reflect.ValueOf(time.Duration(v) * time.Millisecond), true
+		}
+		return reflect.Value{}, false
+	}
+	if s, ok := val.(string); ok && typ == errorType {
+		return reflect.ValueOf(errors.New(s)).Convert(typ), true
+	}
+
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Int:
+		if !isInteger(typ.Kind()) && !isFloat(typ.Kind()) {
+			return reflect.Value{}, false
+		}
+	case reflect.Float64:
+		if !isFloat(typ.Kind()) {
+			return reflect.Value{}, false
+		}
+	default:
+		if v.Kind() != typ.Kind() {
+			return reflect.Value{}, false
+		}
+	}
+	if !v.Type().ConvertibleTo(typ) || overflows(v, typ) {
+		return reflect.Value{}, false
+	}
+	return v.Convert(typ), true
+}
+
+// overflows returns whether the number can not be represented by the number type,
+// e.g. 300 for uint8 or -1 for uint
+func overflows(v reflect.Value, typ reflect.Type) bool {
+	target := reflect.Zero(typ)
+	switch {
+	case v.Kind() == reflect.Int && typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Int64:
+		return target.OverflowInt(v.Int())
+	case v.Kind() == reflect.Int && typ.Kind() >= reflect.Uint && typ.Kind() <= reflect.Uintptr:
+		return v.Int() < 0 || target.OverflowUint(uint64(v.Int()))
+	case v.Kind() == reflect.Float64 && isFloat(typ.Kind()):
+		return target.OverflowFloat(v.Float())
+	}
+	return false
+}
+
+func isInteger(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Uintptr
+}
+
+func isFloat(kind reflect.Kind) bool {
+	return kind == reflect.Float32 || kind == reflect.Float64
+}
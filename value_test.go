@@ -0,0 +1,133 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failpoint_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/failpoint"
+	"github.com/stretchr/testify/require"
+)
+
+type mode string
+
+func TestEvalAs(t *testing.T) {
+	var msgs []string
+	failpoint.SetLogger(failpoint.LoggerFunc(func(msg string, _ ...interface{}) {
+		msgs = append(msgs, msg)
+	}))
+	defer failpoint.SetLogger(nil)
+
+	enable := func(terms string) {
+		require.NoError(t, failpoint.Enable("test-eval-as", terms))
+	}
+	defer func() {
+		require.NoError(t, failpoint.Disable("test-eval-as"))
+	}()
+
+	enable("return(10)")
+	n, err := failpoint.EvalAs[int]("test-eval-as")
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	u, err := failpoint.EvalAs[uint8]("test-eval-as")
+	require.NoError(t, err)
+	require.Equal(t, uint8(10), u)
+	f, err := failpoint.EvalAs[float64]("test-eval-as")
+	require.NoError(t, err)
+	require.Equal(t, 10.0, f)
+	dur, err := failpoint.EvalAs[time.Duration]("test-eval-as")
+	require.NoError(t, err)
+	require.Equal(t, 10*time.Millisecond, dur)
+
+	enable(`return("1s")`)
+	dur, err = failpoint.EvalAs[time.Duration]("test-eval-as")
+	require.NoError(t, err)
+	require.Equal(t, time.Second, dur)
+	e, err := failpoint.EvalAs[error]("test-eval-as")
+	require.NoError(t, err)
+	require.EqualError(t, e, "1s")
+	m, err := failpoint.EvalAs[mode]("test-eval-as")
+	require.NoError(t, err)
+	require.Equal(t, mode("1s"), m)
+
+	enable("return(true)")
+	b, err := failpoint.EvalAs[bool]("test-eval-as")
+	require.NoError(t, err)
+	require.True(t, b)
+
+	enable("return")
+	e, err = failpoint.EvalAs[error]("test-eval-as")
+	require.NoError(t, err)
+	require.Nil(t, e)
+	require.Empty(t, msgs)
+
+	// The mismatched values are logged
+	enable("return(1.5)")
+	_, err = failpoint.EvalAs[int]("test-eval-as")
+	require.Error(t, err)
+	require.True(t, errors.Cause(err) == failpoint.ErrValueType)
+	require.Equal(t, []string{"failpoint test-eval-as: can not use 1.5 as int: failpoint: value type mismatch"}, msgs)
+
+	// The disabled failpoints are not reported
+	require.NoError(t, failpoint.Disable("test-eval-as"))
+	_, err = failpoint.EvalAs[int]("test-eval-as")
+	require.Error(t, err)
+	require.Len(t, msgs, 1)
+
+	enable("return(10)")
+	ctx := failpoint.WithHook(context.Background(), func(context.Context, string) bool { return true })
+	n, err = failpoint.EvalContextAs[int](ctx, "test-eval-as")
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+
+	// The values out of the range of the types are mismatched
+	enable("return(300)")
+	_, err = failpoint.EvalAs[uint8]("test-eval-as")
+	require.True(t, errors.Cause(err) == failpoint.ErrValueType)
+	_, err = failpoint.EvalAs[int8]("test-eval-as")
+	require.True(t, errors.Cause(err) == failpoint.ErrValueType)
+	i16, err := failpoint.EvalAs[int16]("test-eval-as")
+	require.NoError(t, err)
+	require.Equal(t, int16(300), i16)
+	enable("return(-1)")
+	_, err = failpoint.EvalAs[uint]("test-eval-as")
+	require.True(t, errors.Cause(err) == failpoint.ErrValueType)
+	i8, err := failpoint.EvalAs[int8]("test-eval-as")
+	require.NoError(t, err)
+	require.Equal(t, int8(-1), i8)
+	enable("return(10000000000000000000000000000000000000000.0)")
+	_, err = failpoint.EvalAs[float32]("test-eval-as")
+	require.True(t, errors.Cause(err) == failpoint.ErrValueType)
+	enable("return(1.5)")
+	f32, err := failpoint.EvalAs[float32]("test-eval-as")
+	require.NoError(t, err)
+	require.Equal(t, float32(1.5), f32)
+}
+
+func TestEvalOverride(t *testing.T) {
+	require.Equal(t, 1, failpoint.EvalOverride("test-eval-override", 1))
+
+	require.NoError(t, failpoint.Enable("test-eval-override", "1*return(10)->return(1.5)"))
+	defer func() {
+		require.NoError(t, failpoint.Disable("test-eval-override"))
+	}()
+	require.Equal(t, 10, failpoint.EvalOverride("test-eval-override", 1))
+	// The values can not be converted are ignored
+	require.Equal(t, 1, failpoint.EvalOverride("test-eval-override", 1))
+	require.Equal(t, 1.5, failpoint.EvalOverride("test-eval-override", 0.5))
+}